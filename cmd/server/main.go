@@ -6,6 +6,7 @@ import (
 	"chatService/pkg/app"
 	"chatService/pkg/repository"
 	"context"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/joho/godotenv"
@@ -30,6 +31,12 @@ func main() {
 
 	defer db.Close()
 
+	// Tables of the chat storage, the backplane and presence are created up front
+	if err := repository.Migrate(context.Background(), db); err != nil {
+		log.Printf("Unable to migrate database: %v", err)
+		os.Exit(1)
+	}
+
 	firebaseApp := config.SetupFirebase()
 
 	firestore, err := firebaseApp.Firestore(context.Background())
@@ -43,9 +50,24 @@ func main() {
 
 	userService := api.NewUserService(storage)
 
-	chatService := api.NewChatService(storage)
+	chatRepository, err := setupChatRepository(db, storage)
+	if err != nil {
+		log.Printf("Unable to set up chat storage: %v", err)
+		os.Exit(1)
+	}
+
+	chatService := api.NewChatService(chatRepository)
+
+	announcementService := api.NewAnnouncementService(storage)
+
+	backplane, err := setupBackplane(db)
+	if err != nil {
+		log.Printf("Unable to set up backplane: %v", err)
+		os.Exit(1)
+	}
+	defer backplane.Close()
 
-	server := app.NewServer(router, userService, chatService)
+	server := app.NewServer(router, userService, chatService, announcementService, config.LoadWebsocket(), backplane)
 
 	if err = server.Run(); err != nil {
 		log.Println(err)
@@ -60,3 +82,29 @@ func setupDatabase() (*pgxpool.Pool, error) {
 
 	return conn, nil
 }
+
+// setupBackplane returns the backplane selected by HUB_BACKPLANE. Instances only
+// see each other's events with the postgres backplane.
+func setupBackplane(db *pgxpool.Pool) (api.Backplane, error) {
+	switch os.Getenv("HUB_BACKPLANE") {
+	case "postgres":
+		return repository.NewPostgresBackplane(db), nil
+	case "", "memory":
+		return api.NewMemoryBackplane(), nil
+	default:
+		return nil, fmt.Errorf("unknown HUB_BACKPLANE %q", os.Getenv("HUB_BACKPLANE"))
+	}
+}
+
+// setupChatRepository returns the storage of conversations and messages selected
+// by CHAT_STORAGE. Users and announcements are stored the same way either way.
+func setupChatRepository(db *pgxpool.Pool, storage repository.Storage) (api.ChatRepository, error) {
+	switch os.Getenv("CHAT_STORAGE") {
+	case "postgres":
+		return repository.NewPostgresStorage(db), nil
+	case "", "firestore":
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("unknown CHAT_STORAGE %q", os.Getenv("CHAT_STORAGE"))
+	}
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"compress/flate"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Policies applied when the send queue of a slow client is full.
+const (
+	// Drop the oldest queued frame to make room for the new one.
+	DropOldest = "drop_oldest"
+
+	// Replace queued typing, presence, read and activity frames superseded by newer
+	// ones, dropping the oldest of them when the queue is still full.
+	Coalesce = "coalesce"
+
+	// Close the connection so the client reconnects and syncs.
+	Disconnect = "disconnect"
+)
+
+// Websocket holds the limits and timeouts of websocket connections.
+type Websocket struct {
+	// Buffer sizes used by the upgrader for reading and writing.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Maximum size in bytes of a frame sent by the peer.
+	MaxMessageSize int64
+
+	// Time allowed to write a message to the peer.
+	WriteWait time.Duration
+
+	// Time allowed to read the next pong message from the peer.
+	PongWait time.Duration
+
+	// Send pings to peer with this period. Must be less than PongWait.
+	PingPeriod time.Duration
+
+	// Whether permessage-deflate compression is negotiated with peers that support it.
+	EnableCompression bool
+
+	// Compression level of outgoing messages, see compress/flate.
+	CompressionLevel int
+
+	// Maximum number of frames queued for delivery to a client.
+	SendQueueSize int
+
+	// Policy applied when the send queue of a client is full.
+	SlowConsumerPolicy string
+
+	// Minimum time clients wait before reconnecting when the server shuts down.
+	ReconnectAfter time.Duration
+}
+
+// LoadWebsocket reads the websocket configuration from the environment, falling
+// back to defaults for unset or invalid values.
+func LoadWebsocket() Websocket {
+	config := Websocket{
+		ReadBufferSize:    sizeFromEnv("WS_READ_BUFFER_SIZE", 8192),
+		WriteBufferSize:   sizeFromEnv("WS_WRITE_BUFFER_SIZE", 8192),
+		MaxMessageSize:    int64(sizeFromEnv("WS_MAX_MESSAGE_SIZE", 64*1024)),
+		WriteWait:         durationFromEnv("WS_WRITE_WAIT", 10*time.Second),
+		PongWait:          durationFromEnv("WS_PONG_WAIT", 60*time.Second),
+		EnableCompression: boolFromEnv("WS_ENABLE_COMPRESSION", true),
+		CompressionLevel:  intFromEnv("WS_COMPRESSION_LEVEL", flate.BestSpeed),
+		SendQueueSize:     sizeFromEnv("WS_SEND_QUEUE_SIZE", 256),
+		ReconnectAfter:    durationFromEnv("WS_RECONNECT_AFTER", 2*time.Second),
+	}
+	config.PingPeriod = durationFromEnv("WS_PING_PERIOD", (config.PongWait*9)/10)
+
+	if config.PingPeriod >= config.PongWait {
+		log.Printf("WS_PING_PERIOD must be less than WS_PONG_WAIT, using %v", (config.PongWait*9)/10)
+		config.PingPeriod = (config.PongWait * 9) / 10
+	}
+
+	if config.CompressionLevel < flate.HuffmanOnly || config.CompressionLevel > flate.BestCompression {
+		log.Printf("Invalid WS_COMPRESSION_LEVEL %d, using %d", config.CompressionLevel, flate.BestSpeed)
+		config.CompressionLevel = flate.BestSpeed
+	}
+
+	config.SlowConsumerPolicy = os.Getenv("WS_SLOW_CONSUMER_POLICY")
+	switch config.SlowConsumerPolicy {
+	case DropOldest, Coalesce, Disconnect:
+	case "":
+		config.SlowConsumerPolicy = Disconnect
+	default:
+		log.Printf("Invalid WS_SLOW_CONSUMER_POLICY %q, using %s", config.SlowConsumerPolicy, Disconnect)
+		config.SlowConsumerPolicy = Disconnect
+	}
+
+	return config
+}
+
+func intFromEnv(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func sizeFromEnv(key string, fallback int) int {
+	size := intFromEnv(key, fallback)
+	if size <= 0 {
+		log.Printf("Invalid %s %d, using %d", key, size, fallback)
+		return fallback
+	}
+
+	return size
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid %s %q, using %v", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func boolFromEnv(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %t", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"github.com/gorilla/websocket"
+	"sort"
+	"time"
+)
+
+const (
+	// Close reason sent to connections closed through the admin API.
+	adminDisconnectReason = "Disconnected by administrator"
+
+	// Type of the backplane events relaying disconnect requests.
+	adminDisconnectType = "admin.disconnect"
+)
+
+// Session describes a single connection of a user.
+type Session struct {
+	Id            string    `json:"id"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	Transport     string    `json:"transport"`
+	Subprotocol   string    `json:"subprotocol"`
+	QueueDepth    int       `json:"queueDepth"`
+	QueueCapacity int       `json:"queueCapacity"`
+	FramesDropped int64     `json:"framesDropped"`
+	Coalesced     int64     `json:"framesCoalesced"`
+	Replaying     bool      `json:"replaying"`
+	Subscriptions int       `json:"subscriptions"`
+}
+
+// UserConnections lists the sessions of a connected user.
+type UserConnections struct {
+	UserId   string    `json:"userId"`
+	Sessions []Session `json:"sessions"`
+}
+
+// HubStats holds counters of a Hub since it started. Counters are only modified
+// by the Hub goroutine.
+type HubStats struct {
+	Instance          string    `json:"instance"`
+	StartedAt         time.Time `json:"startedAt"`
+	Users             int       `json:"users"`
+	Connections       int       `json:"connections"`
+	ConnectionsOpened int64     `json:"connectionsOpened"`
+	ConnectionsClosed int64     `json:"connectionsClosed"`
+	EventsSent        int64     `json:"eventsSent"`
+	EventsRelayed     int64     `json:"eventsRelayed"`
+	FramesQueued      int64     `json:"framesQueued"`
+	FramesDropped     int64     `json:"framesDropped"`
+	FramesCoalesced   int64     `json:"framesCoalesced"`
+	ClientsDropped    int64     `json:"clientsDropped"`
+}
+
+// inspect runs fn on the Hub goroutine, so it can safely read and modify clients.
+func (h *Hub) inspect(fn func()) {
+	done := make(chan struct{})
+	select {
+	case h.inspection <- func() {
+		fn()
+		close(done)
+	}:
+		<-done
+	case <-h.done:
+	}
+}
+
+// Connections returns the sessions of all connected users, ordered by user id.
+func (h *Hub) Connections() []UserConnections {
+	var connections []UserConnections
+
+	h.inspect(func() {
+		for uid, clients := range h.clients {
+			connections = append(connections, UserConnections{UserId: uid, Sessions: sessions(clients)})
+		}
+	})
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].UserId < connections[j].UserId
+	})
+	return connections
+}
+
+// UserConnections returns the sessions of a user, or false when the user is not
+// connected to this instance.
+func (h *Hub) UserConnections(userId string) (UserConnections, bool) {
+	var connections UserConnections
+	var ok bool
+
+	h.inspect(func() {
+		clients, found := h.clients[userId]
+		if !found {
+			return
+		}
+		connections = UserConnections{UserId: userId, Sessions: sessions(clients)}
+		ok = true
+	})
+
+	return connections, ok
+}
+
+// Disconnect closes the sessions of a user, or only the session with sessionId
+// when it is not empty. The request is relayed to the other instances, which
+// close the matching sessions they hold.
+func (h *Hub) Disconnect(userId string, sessionId string) {
+	request := disconnectRequest{UserId: userId, SessionId: sessionId}
+
+	h.inspect(func() {
+		h.disconnect(request)
+		h.publishEvent(backplaneEvent{Type: adminDisconnectType, Disconnect: &request})
+	})
+}
+
+// disconnect closes the sessions of this Hub matching a request.
+func (h *Hub) disconnect(request disconnectRequest) {
+	var clients []*Client
+	for _, client := range h.clients[request.UserId] {
+		if request.SessionId == "" || client.sessionId == request.SessionId {
+			clients = append(clients, client)
+		}
+	}
+
+	for _, client := range clients {
+		h.removeClient(client, websocket.ClosePolicyViolation, adminDisconnectReason)
+	}
+}
+
+// Stats returns the counters of the Hub.
+func (h *Hub) Stats() HubStats {
+	var stats HubStats
+
+	h.inspect(func() {
+		stats = h.stats
+		stats.Users = len(h.clients)
+		for _, clients := range h.clients {
+			stats.Connections += len(clients)
+		}
+	})
+
+	return stats
+}
+
+func sessions(clients []*Client) []Session {
+	sessions := make([]Session, len(clients))
+	for i, client := range clients {
+		depth, dropped, coalesced := client.outbox.stats()
+		if client.backlog != nil {
+			heldDepth, heldDropped, heldCoalesced := client.backlog.stats()
+			depth += heldDepth
+			dropped += heldDropped
+			coalesced += heldCoalesced
+		}
+
+		transport := "websocket"
+		if client.conn == nil {
+			transport = "sse"
+		}
+
+		sessions[i] = Session{
+			Id:            client.sessionId,
+			ConnectedAt:   client.connectedAt,
+			RemoteAddr:    client.remoteAddr,
+			Transport:     transport,
+			Subprotocol:   client.codec.Subprotocol(),
+			QueueDepth:    depth,
+			QueueCapacity: client.outbox.capacity,
+			FramesDropped: dropped,
+			Coalesced:     coalesced,
+			Replaying:     client.replaying,
+			Subscriptions: len(client.subscriptions),
+		}
+	}
+	return sessions
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	InfoSeverity     = "INFO"
+	WarningSeverity  = "WARNING"
+	CriticalSeverity = "CRITICAL"
+
+	// Lifetime of announcements published without an expiry.
+	defaultAnnouncementLifetime = 24 * time.Hour
+)
+
+type AnnouncementService interface {
+	CreateAnnouncement(announcement Announcement, userId string) (Announcement, error)
+	GetActiveAnnouncements(userId string) ([]Announcement, error)
+	GetAnnouncements() ([]Announcement, error)
+	ExpireAnnouncement(announcementId string) (Announcement, error)
+}
+
+type AnnouncementRepository interface {
+	CreateAnnouncement(announcement Announcement) (Announcement, error)
+	GetActiveAnnouncements(now time.Time) ([]Announcement, error)
+	ExpireAnnouncement(announcementId string, expiresAt time.Time) (Announcement, error)
+}
+
+type announcementService struct {
+	storage AnnouncementRepository
+}
+
+func NewAnnouncementService(storage AnnouncementRepository) AnnouncementService {
+	return &announcementService{storage: storage}
+}
+
+func (a *announcementService) CreateAnnouncement(announcement Announcement, userId string) (Announcement, error) {
+	announcement.Title = strings.TrimSpace(announcement.Title)
+	announcement.Body = strings.TrimSpace(announcement.Body)
+	if announcement.Title == "" || announcement.Body == "" {
+		return Announcement{}, ErrInvalidAnnouncement
+	}
+
+	switch announcement.Severity {
+	case InfoSeverity, WarningSeverity, CriticalSeverity:
+	case "":
+		announcement.Severity = InfoSeverity
+	default:
+		return Announcement{}, ErrInvalidAnnouncement
+	}
+
+	now := time.Now()
+	if announcement.ExpiresAt.IsZero() {
+		announcement.ExpiresAt = now.Add(defaultAnnouncementLifetime)
+	} else if !announcement.ExpiresAt.After(now) {
+		return Announcement{}, ErrInvalidAnnouncement
+	}
+
+	announcement.Id = ""
+	announcement.CreatedAt = now
+	announcement.CreatedBy = userId
+
+	announcement, err := a.storage.CreateAnnouncement(announcement)
+
+	if err != nil {
+		return announcement, err
+	}
+
+	return announcement, nil
+}
+
+// GetActiveAnnouncements returns the unexpired announcements addressed to a user.
+func (a *announcementService) GetActiveAnnouncements(userId string) ([]Announcement, error) {
+	announcements, err := a.storage.GetActiveAnnouncements(time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var userAnnouncements []Announcement
+	for _, announcement := range announcements {
+		if len(announcement.UserIds) == 0 || contains(announcement.UserIds, userId) {
+			userAnnouncements = append(userAnnouncements, announcement)
+		}
+	}
+
+	return userAnnouncements, nil
+}
+
+// GetAnnouncements returns all unexpired announcements.
+func (a *announcementService) GetAnnouncements() ([]Announcement, error) {
+	announcements, err := a.storage.GetActiveAnnouncements(time.Now())
+
+	if err != nil {
+		return announcements, err
+	}
+
+	return announcements, nil
+}
+
+// ExpireAnnouncement ends an announcement before its expiry.
+func (a *announcementService) ExpireAnnouncement(announcementId string) (Announcement, error) {
+	announcement, err := a.storage.ExpireAnnouncement(announcementId, time.Now())
+
+	if err != nil {
+		return announcement, err
+	}
+
+	return announcement, nil
+}
+
+// announcementEvent wraps an announcement in an event addressed to its target users.
+func announcementEvent(eventType string, announcement Announcement) OutgoingEvent {
+	return OutgoingEvent{
+		Type:         eventType,
+		Participants: announcement.UserIds,
+		Announcement: &announcement,
+	}
+}
+
+// Announce sends a published announcement to the connected target users, or to
+// every connected user when it is not targeted.
+func (h *Hub) Announce(announcement Announcement) {
+	select {
+	case h.broadcast <- announcementEvent(AnnouncementPublished, announcement):
+	case <-h.done:
+	}
+}
+
+// Withdraw tells the target users that an announcement expired early.
+func (h *Hub) Withdraw(announcement Announcement) {
+	select {
+	case h.broadcast <- announcementEvent(AnnouncementWithdrawn, announcement):
+	case <-h.done:
+	}
+}
+
+// broadcastEvent delivers an event to the clients of its participants, or to all
+// clients when the event has no participants.
+func (h *Hub) broadcastEvent(outgoingEvent OutgoingEvent) {
+	messages := make(map[Codec][]byte)
+	var slowClients []*Client
+
+	deliver := func(client *Client) {
+		message := encodeCached(messages, client.codec, outgoingEvent)
+		if message == nil {
+			return
+		}
+
+		if !h.queue(client, frame{data: message}) {
+			slowClients = append(slowClients, client)
+		}
+	}
+
+	if len(outgoingEvent.Participants) == 0 {
+		for _, clients := range h.clients {
+			for _, client := range clients {
+				deliver(client)
+			}
+		}
+	} else {
+		for _, uid := range outgoingEvent.Participants {
+			for _, client := range h.clients[uid] {
+				deliver(client)
+			}
+		}
+	}
+
+	h.dropSlowClients(slowClients)
+}
+
+// SendAnnouncements delivers the active announcements of the user to a Client
+// that just connected.
+func (c *Client) SendAnnouncements(announcementService AnnouncementService) {
+	announcements, err := announcementService.GetActiveAnnouncements(c.id)
+	if err != nil {
+		log.Printf("Unable to get announcements of user %s: %v", c.id, err)
+		return
+	}
+
+	for _, announcement := range announcements {
+		message, err := encodeEvent(c.codec, announcementEvent(AnnouncementPublished, announcement))
+		if err != nil {
+			log.Printf("Could not process announcement: %v", err)
+			continue
+		}
+		c.Hub.sendDirect(c, message)
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+)
+
+// Backplane relays events between the hubs of all server instances, so users
+// connected to different instances receive each other's events.
+type Backplane interface {
+	// Publish relays a message to every Hub subscribed to the backplane, including
+	// the publishing one. It must not block the calling Hub.
+	Publish(message []byte) error
+
+	// Subscribe returns the messages published to the backplane. The channel is
+	// closed when the backplane is closed.
+	Subscribe() (<-chan []byte, error)
+
+	Close() error
+}
+
+var ErrBackplaneClosed = errors.New("backplane is closed")
+
+// Number of messages buffered for each subscriber of the in-memory backplane.
+const memoryBackplaneBuffer = 256
+
+// backplaneEvent is an event relayed through the Backplane.
+type backplaneEvent struct {
+	// Id of the Hub that published the event
+	Origin string        `json:"origin"`
+	Type   string        `json:"type"`
+	Event  OutgoingEvent `json:"event"`
+
+	// Whether the event is broadcast rather than sent to its participants
+	Broadcast bool `json:"broadcast,omitempty"`
+
+	// Sessions to close on every instance instead of delivering an event
+	Disconnect *disconnectRequest `json:"disconnect,omitempty"`
+
+	// User whose receive-only connections are marked active instead of delivering an event
+	ActiveUserId string `json:"activeUserId,omitempty"`
+}
+
+// Type of the backplane events relaying activity of users through the REST API.
+const userActivityType = "user.activity"
+
+// disconnectRequest asks the hubs to close the sessions of a user, or only the
+// session with SessionId when it is not empty.
+type disconnectRequest struct {
+	UserId    string `json:"userId"`
+	SessionId string `json:"sessionId,omitempty"`
+}
+
+// publish relays an event delivered by this Hub to the other instances.
+func (h *Hub) publish(outgoingEvent OutgoingEvent, broadcast bool) {
+	outgoingEvent.Client = nil
+
+	h.publishEvent(backplaneEvent{
+		Type:      outgoingEvent.Type,
+		Event:     outgoingEvent,
+		Broadcast: broadcast,
+	})
+}
+
+// publishEvent sends an event to the hubs of the other instances.
+func (h *Hub) publishEvent(event backplaneEvent) {
+	event.Origin = h.id
+
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Could not encode event for backplane: %v", err)
+		return
+	}
+
+	if err := h.backplane.Publish(message); err != nil {
+		log.Printf("Unable to publish %s event to backplane: %v", event.Type, err)
+	}
+}
+
+// consume hands the events published by other instances to the Hub until the
+// backplane is closed or the Hub stopped.
+func (h *Hub) consume(messages <-chan []byte) {
+	for {
+		var message []byte
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return
+			}
+			message = m
+		case <-h.done:
+			return
+		}
+
+		var event backplaneEvent
+		if err := json.Unmarshal(message, &event); err != nil {
+			log.Printf("Could not process backplane message: %v", err)
+			continue
+		}
+
+		// Events of this instance were already delivered locally
+		if event.Origin == h.id {
+			continue
+		}
+
+		select {
+		case h.relay <- event:
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// newId returns a random id identifying a Hub or a session.
+func newId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalf("Unable to generate id: %v", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// memoryBackplane relays messages between hubs of the same process.
+type memoryBackplane struct {
+	subscribers []chan []byte
+	closed      bool
+	mutex       sync.Mutex
+}
+
+// NewMemoryBackplane returns a Backplane for a single instance, or for several
+// hubs sharing one process in tests.
+func NewMemoryBackplane() Backplane {
+	return &memoryBackplane{}
+}
+
+func (b *memoryBackplane) Publish(message []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return ErrBackplaneClosed
+	}
+
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber <- message:
+		default:
+			log.Printf("Backplane subscriber is full, dropping message")
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackplane) Subscribe() (<-chan []byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrBackplaneClosed
+	}
+
+	subscriber := make(chan []byte, memoryBackplaneBuffer)
+	b.subscribers = append(b.subscribers, subscriber)
+	return subscriber, nil
+}
+
+func (b *memoryBackplane) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	for _, subscriber := range b.subscribers {
+		close(subscriber)
+	}
+	b.subscribers = nil
+	return nil
+}
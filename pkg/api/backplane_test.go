@@ -0,0 +1,27 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsumeStopsWithHub(t *testing.T) {
+	h := &Hub{relay: make(chan backplaneEvent), done: make(chan struct{})}
+	messages := make(chan []byte, 1)
+
+	stopped := make(chan struct{})
+	go func() {
+		h.consume(messages)
+		close(stopped)
+	}()
+
+	// The Hub no longer receives relayed events once stopped
+	messages <- []byte(`{"type":"message.add","origin":"other"}`)
+	close(h.done)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("consume did not return after the Hub stopped")
+	}
+}
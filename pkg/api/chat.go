@@ -1,25 +1,65 @@
 package api
 
+import (
+	"errors"
+	"time"
+)
+
 type ChatService interface {
-	AddMessage(incomingEvent IncomingEvent) (OutgoingEvent, error)
-	AddParticipant(incomingEvent IncomingEvent) (OutgoingEvent, error)
+	AddMessage(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	AddParticipant(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	RemoveMessage(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	EditMessage(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	GetParticipants(conversationId string) ([]string, error)
+	MarkConversationAsRead(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	GetContactIds(userId string) ([]string, error)
+	AddReaction(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	RemoveReaction(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	GetThread(userId string, conversationId string, messageId string, before time.Time, limit int) (Thread, error)
+	MarkThreadAsRead(userId string, conversationId string, messageId string) error
+	GetMissedEvents(userId string, cursors map[string]int64) ([]OutgoingEvent, error)
+	GetEventsSince(userId string, since time.Time) ([]OutgoingEvent, error)
+	RemoveParticipant(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
 	UpdateConversation()
-	UpdateUserConversation(patchJson []byte, userId string, conversationId string) error
 	GetConversation(userId string, conversationId string) (Conversation, error)
 	GetConversations(userId string) ([]Conversation, error)
 	CreateConversation(newConversation NewConversation, userId string) (Conversation, error)
+	GetConversationAddedEvents(conversationId string, userIds []string) ([]OutgoingEvent, error)
 }
 
 type ChatRepository interface {
 	AddMessage(incomingEvent IncomingEvent) (OutgoingEvent, error)
 	AddParticipant(incomingEvent IncomingEvent) (OutgoingEvent, error)
+	RemoveMessage(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	EditMessage(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	GetParticipants(conversationId string) ([]string, error)
+	MarkConversationAsRead(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	GetContactIds(userId string) ([]string, error)
+	AddReaction(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	RemoveReaction(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
+	GetThread(userId string, conversationId string, messageId string, before time.Time, limit int) (Thread, error)
+	MarkThreadAsRead(userId string, conversationId string, messageId string) error
+	GetMissedEvents(userId string, cursors map[string]int64) ([]OutgoingEvent, error)
+	GetEventsSince(userId string, since time.Time) ([]OutgoingEvent, error)
+	RemoveParticipant(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error)
 	UpdateConversation()
-	UpdateUserConversation(patchJson []byte, userId string, conversationId string) error
 	GetConversation(userId string, conversationId string) (Conversation, error)
 	GetConversations(userId string) ([]Conversation, error)
 	CreateConversation(newConversation NewConversation, userId string) (Conversation, error)
 }
 
+const (
+	// Maximum length in bytes of a reaction, enough for emoji built from several code points.
+	maxReactionLength = 32
+
+	// Maximum length in bytes of the key clients attach to messages to deduplicate retries.
+	maxClientKeyLength = 64
+
+	// Default and maximum number of replies returned for a page of a thread.
+	defaultThreadPageSize = 20
+	maxThreadPageSize     = 100
+)
+
 type chatService struct {
 	storage ChatRepository
 }
@@ -28,19 +68,29 @@ func NewChatService(storage ChatRepository) ChatService {
 	return &chatService{storage: storage}
 }
 
-func (c *chatService) UpdateConversation() {
-	//TODO implement me
-	panic("implement me")
-}
-
-func (c *chatService) UpdateUserConversation(patchJson []byte, userId string, conversationId string) error {
-	err := c.storage.UpdateUserConversation(patchJson, userId, conversationId)
-
-	if err != nil {
+// authorize checks that the user is a participant of the conversation. Conversations
+// that do not exist are reported as forbidden like those of other users, so their
+// existence is not revealed.
+func (c *chatService) authorize(userId string, conversationId string) error {
+	participants, err := c.storage.GetParticipants(conversationId)
+	if errors.Is(err, ErrConversationNotFound) {
+		return ErrForbidden
+	} else if err != nil {
 		return err
 	}
 
-	return nil
+	for _, id := range participants {
+		if id == userId {
+			return nil
+		}
+	}
+
+	return ErrForbidden
+}
+
+func (c *chatService) UpdateConversation() {
+	//TODO implement me
+	panic("implement me")
 }
 
 func (c *chatService) GetConversation(userId string, conversationId string) (Conversation, error) {
@@ -65,6 +115,14 @@ func (c *chatService) GetConversations(userId string) ([]Conversation, error) {
 }
 
 func (c *chatService) CreateConversation(newConversation NewConversation, userId string) (Conversation, error) {
+	// Users can only create conversations they take part in
+	if !contains(newConversation.Participants, userId) {
+		return Conversation{}, ErrForbidden
+	}
+
+	// The first message is always sent by the creator of the conversation
+	newConversation.Message.SenderId = userId
+
 	conversation, err := c.storage.CreateConversation(newConversation, userId)
 
 	if err != nil {
@@ -74,7 +132,22 @@ func (c *chatService) CreateConversation(newConversation NewConversation, userId
 	return conversation, nil
 }
 
-func (c *chatService) AddMessage(incomingEvent IncomingEvent) (OutgoingEvent, error) {
+func (c *chatService) AddMessage(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error) {
+	if incomingEvent.Message == nil {
+		return OutgoingEvent{}, ErrInvalidMessage
+	}
+
+	if len(incomingEvent.Message.ClientKey) > maxClientKeyLength {
+		return OutgoingEvent{}, ErrInvalidClientKey
+	}
+
+	if err := c.authorize(userId, incomingEvent.ConversationId); err != nil {
+		return OutgoingEvent{}, err
+	}
+
+	// Messages are always sent by the authenticated user
+	incomingEvent.Message.SenderId = userId
+
 	outgoingEvent, err := c.storage.AddMessage(incomingEvent)
 
 	if err != nil {
@@ -84,7 +157,32 @@ func (c *chatService) AddMessage(incomingEvent IncomingEvent) (OutgoingEvent, er
 	return outgoingEvent, nil
 }
 
-func (c *chatService) AddParticipant(incomingEvent IncomingEvent) (OutgoingEvent, error) {
+// GetConversationAddedEvents returns an event for each user that joined a conversation,
+// carrying the conversation as the user sees it so clients can add it to their list.
+func (c *chatService) GetConversationAddedEvents(conversationId string, userIds []string) ([]OutgoingEvent, error) {
+	var outgoingEvents []OutgoingEvent
+	for _, userId := range userIds {
+		conversation, err := c.storage.GetConversation(userId, conversationId)
+		if err != nil {
+			return outgoingEvents, err
+		}
+
+		outgoingEvents = append(outgoingEvents, OutgoingEvent{
+			ConversationId: conversationId,
+			Type:           ConversationAdded,
+			Participants:   []string{userId},
+			Conversation:   &conversation,
+		})
+	}
+
+	return outgoingEvents, nil
+}
+
+func (c *chatService) AddParticipant(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error) {
+	if err := c.authorize(userId, incomingEvent.ConversationId); err != nil {
+		return OutgoingEvent{}, err
+	}
+
 	outgoingEvent, err := c.storage.AddParticipant(incomingEvent)
 
 	if err != nil {
@@ -93,3 +191,164 @@ func (c *chatService) AddParticipant(incomingEvent IncomingEvent) (OutgoingEvent
 
 	return outgoingEvent, nil
 }
+
+func (c *chatService) RemoveMessage(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error) {
+	if err := c.authorize(userId, incomingEvent.ConversationId); err != nil {
+		return OutgoingEvent{}, err
+	}
+
+	outgoingEvent, err := c.storage.RemoveMessage(incomingEvent, userId)
+
+	if err != nil {
+		return outgoingEvent, err
+	}
+
+	return outgoingEvent, nil
+}
+
+func (c *chatService) RemoveParticipant(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error) {
+	if err := c.authorize(userId, incomingEvent.ConversationId); err != nil {
+		return OutgoingEvent{}, err
+	}
+
+	outgoingEvent, err := c.storage.RemoveParticipant(incomingEvent, userId)
+
+	if err != nil {
+		return outgoingEvent, err
+	}
+
+	return outgoingEvent, nil
+}
+
+func (c *chatService) EditMessage(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error) {
+	if err := c.authorize(userId, incomingEvent.ConversationId); err != nil {
+		return OutgoingEvent{}, err
+	}
+
+	outgoingEvent, err := c.storage.EditMessage(incomingEvent, userId)
+
+	if err != nil {
+		return outgoingEvent, err
+	}
+
+	return outgoingEvent, nil
+}
+
+func (c *chatService) GetParticipants(conversationId string) ([]string, error) {
+	participants, err := c.storage.GetParticipants(conversationId)
+
+	if err != nil {
+		return participants, err
+	}
+
+	return participants, nil
+}
+
+func (c *chatService) MarkConversationAsRead(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error) {
+	if err := c.authorize(userId, incomingEvent.ConversationId); err != nil {
+		return OutgoingEvent{}, err
+	}
+
+	outgoingEvent, err := c.storage.MarkConversationAsRead(incomingEvent, userId)
+
+	if err != nil {
+		return outgoingEvent, err
+	}
+
+	return outgoingEvent, nil
+}
+
+func (c *chatService) GetContactIds(userId string) ([]string, error) {
+	contactIds, err := c.storage.GetContactIds(userId)
+
+	if err != nil {
+		return contactIds, err
+	}
+
+	return contactIds, nil
+}
+
+func (c *chatService) AddReaction(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error) {
+	if incomingEvent.Reaction == "" || len(incomingEvent.Reaction) > maxReactionLength {
+		return OutgoingEvent{}, ErrInvalidReaction
+	}
+
+	if err := c.authorize(userId, incomingEvent.ConversationId); err != nil {
+		return OutgoingEvent{}, err
+	}
+
+	outgoingEvent, err := c.storage.AddReaction(incomingEvent, userId)
+
+	if err != nil {
+		return outgoingEvent, err
+	}
+
+	return outgoingEvent, nil
+}
+
+func (c *chatService) RemoveReaction(incomingEvent IncomingEvent, userId string) (OutgoingEvent, error) {
+	if incomingEvent.Reaction == "" || len(incomingEvent.Reaction) > maxReactionLength {
+		return OutgoingEvent{}, ErrInvalidReaction
+	}
+
+	if err := c.authorize(userId, incomingEvent.ConversationId); err != nil {
+		return OutgoingEvent{}, err
+	}
+
+	outgoingEvent, err := c.storage.RemoveReaction(incomingEvent, userId)
+
+	if err != nil {
+		return outgoingEvent, err
+	}
+
+	return outgoingEvent, nil
+}
+
+func (c *chatService) GetThread(userId string, conversationId string, messageId string, before time.Time, limit int) (Thread, error) {
+	if limit <= 0 {
+		limit = defaultThreadPageSize
+	} else if limit > maxThreadPageSize {
+		limit = maxThreadPageSize
+	}
+
+	thread, err := c.storage.GetThread(userId, conversationId, messageId, before, limit)
+
+	if err != nil {
+		return thread, err
+	}
+
+	return thread, nil
+}
+
+func (c *chatService) MarkThreadAsRead(userId string, conversationId string, messageId string) error {
+	err := c.storage.MarkThreadAsRead(userId, conversationId, messageId)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *chatService) GetMissedEvents(userId string, cursors map[string]int64) ([]OutgoingEvent, error) {
+	outgoingEvents, err := c.storage.GetMissedEvents(userId, cursors)
+
+	if err != nil {
+		return outgoingEvents, err
+	}
+
+	return outgoingEvents, nil
+}
+
+// GetEventsSince returns the events of the user's conversations persisted after
+// since, up to maxReplayEvents per conversation, for clients that resume from a
+// position instead of per conversation cursors.
+func (c *chatService) GetEventsSince(userId string, since time.Time) ([]OutgoingEvent, error) {
+	outgoingEvents, err := c.storage.GetEventsSince(userId, since)
+
+	if err != nil {
+		return outgoingEvents, err
+	}
+
+	return outgoingEvents, nil
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+// createRepository records the conversations created through the chat service.
+type createRepository struct {
+	ChatRepository
+	created []NewConversation
+}
+
+func (r *createRepository) CreateConversation(newConversation NewConversation, userId string) (Conversation, error) {
+	r.created = append(r.created, newConversation)
+	return Conversation{Id: "c"}, nil
+}
+
+func TestCreateConversation(t *testing.T) {
+	tests := []struct {
+		name         string
+		participants []string
+		err          error
+	}{
+		{name: "creator is a participant", participants: []string{"me", "friend"}},
+		{name: "group with the creator", participants: []string{"friend", "me", "stranger"}},
+		{name: "conversation between other users", participants: []string{"friend", "stranger"}, err: ErrForbidden},
+		{name: "no participants", err: ErrForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := &createRepository{}
+			service := NewChatService(storage)
+
+			_, err := service.CreateConversation(NewConversation{Participants: test.participants}, "me")
+			if !errors.Is(err, test.err) {
+				t.Errorf("CreateConversation = %v, want %v", err, test.err)
+			}
+			if created := len(storage.created) == 1; created != (test.err == nil) {
+				t.Errorf("created = %v, want %v", created, test.err == nil)
+			}
+		})
+	}
+}
@@ -7,25 +7,20 @@ package api
 import (
 	"bytes"
 	"chatService/config"
-	"context"
-	"encoding/json"
+	"errors"
+	"firebase.google.com/go/v4/auth"
 	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 )
 
 const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 4096
+	// Time after which a typing indicator expires if the peer never stops it.
+	typingTimeout = 5 * time.Second
 )
 
 var (
@@ -37,42 +32,95 @@ var (
 type Client struct {
 	Hub *Hub
 
-	// The websocket connection.
+	// The websocket connection. Nil for receive-only clients served as server-sent events.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// Bounded queue of outbound messages.
+	outbox *outbox
 
 	// ID of the user
 	id string
 
+	// ID of the connection, distinguishing the devices of a user
+	sessionId string
+
+	// When and from where the connection was opened
+	connectedAt time.Time
+	remoteAddr  string
+
+	// Encodes frames for the negotiated subprotocol
+	codec Codec
+
 	// Access to chat features
 	chatService ChatService
 
-	// Whether the Client has sent over auth token
-	isAuthenticated bool
+	// Verifies ID tokens sent to re-authenticate
+	auth *auth.Client
+
+	// Expiry and issue time of the ID token the Client is authenticated with
+	tokenExpiresAt time.Time
+	tokenIssuedAt  time.Time
+	sessionMutex   sync.Mutex
+
+	// Signals the session watcher that the ID token was replaced
+	reauthenticated chan struct{}
+
+	// Whether live events are held back while missed events are replayed.
+	// Only accessed by the Hub.
+	replaying bool
+
+	// Live events held back during a replay, bounded like the outbox.
+	// Only accessed by the Hub.
+	backlog *outbox
+
+	// Signals requests the user made through the REST API, for receive-only
+	// clients that never send frames. Nil for websocket connections.
+	activity chan struct{}
+
+	// Participants of the conversations the Client focuses on, keyed by conversation
+	// id. Nil until the Client subscribes, meaning every event is delivered.
+	// Only accessed by the Hub.
+	subscriptions map[string][]string
+
+	// Active typing indicators keyed by conversation id
+	typing      map[string]*typingState
+	typingMutex sync.Mutex
 }
 
-func NewClient(hub *Hub, conn *websocket.Conn, send chan []byte, id string, chatService ChatService) *Client {
-	return &Client{
-		Hub:             hub,
-		conn:            conn,
-		send:            send,
-		id:              id,
-		isAuthenticated: false,
-		chatService:     chatService,
+func NewClient(hub *Hub, conn *websocket.Conn, token *auth.Token, authClient *auth.Client, chatService ChatService) *Client {
+	client := newClient(hub, token, authClient, chatService, conn.RemoteAddr().String())
+	client.conn = conn
+
+	if codec, ok := CodecFor(conn.Subprotocol()); ok {
+		client.codec = codec
 	}
+
+	// Only applies when permessage-deflate was negotiated
+	if err := conn.SetCompressionLevel(hub.config.CompressionLevel); err != nil {
+		log.Printf("Unable to set compression level: %v", err)
+	}
+
+	return client
 }
 
-// TODO: Possibly look into better way of unmarshalling event
+func newClient(hub *Hub, token *auth.Token, authClient *auth.Client, chatService ChatService, remoteAddr string) *Client {
+	client := &Client{
+		Hub:             hub,
+		outbox:          newOutbox(hub.config.SendQueueSize, hub.config.SlowConsumerPolicy),
+		id:              token.UID,
+		sessionId:       newId(),
+		connectedAt:     time.Now(),
+		remoteAddr:      remoteAddr,
+		codec:           JSONCodec,
+		chatService:     chatService,
+		auth:            authClient,
+		reauthenticated: make(chan struct{}, 1),
+		typing:          make(map[string]*typingState),
+	}
+	client.setToken(token)
 
-const (
-	AddMessage        = 1
-	AddParticipant    = 2
-	RemoveMessage     = 3
-	RemoveParticipant = 4
-	Authenticate      = 5
-)
+	return client
+}
 
 // ReadPump pumps messages from the ws connection to the Hub.
 //
@@ -80,22 +128,37 @@ const (
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
 func (c *Client) ReadPump() {
+	// Marks the connection as idle when the peer stops sending messages
+	idleTimer := time.AfterFunc(idleTimeout, func() {
+		c.Hub.presence.idle(c)
+	})
+
+	// Ends the session when the ID token expires or the account is revoked
+	done := make(chan struct{})
+	go c.watchSession(done)
+
 	defer func() {
-		c.Hub.unregister <- c
+		close(done)
+		idleTimer.Stop()
+		c.stopAllTyping()
+		select {
+		case c.Hub.unregister <- c:
+		case <-c.Hub.done:
+		}
 		err := c.conn.Close()
 		if err != nil {
 			log.Printf("Could not close network connection: %v", err)
 		}
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	err := c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	config := c.Hub.config
+	err := c.conn.SetReadDeadline(time.Now().Add(config.PongWait))
 	if err != nil {
 		log.Printf("Unable to set read deadline: %v", err)
 		return
 	}
 
 	c.conn.SetPongHandler(func(string) error {
-		err := c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		err := c.conn.SetReadDeadline(time.Now().Add(config.PongWait))
 		if err != nil {
 			log.Printf("Unable to set read deadline: %v", err)
 			return err
@@ -103,81 +166,155 @@ func (c *Client) ReadPump() {
 		return nil
 	})
 
-	ctx := context.Background()
-
-	auth, err := config.SetupFirebase().Auth(ctx)
-	if err != nil {
-		return
-	}
-
-	// Starts timer for user to authenticate in 5 seconds
-	disconnectTimer := time.NewTimer(30 * time.Second)
-
-	// If user does not authenticate within allotted time then disconnect Client
-	go func() {
-		<-disconnectTimer.C
-		errMessage, _ := json.Marshal("Did not authenticate Client within 5 seconds")
-		c.send <- errMessage
-		return
-	}()
-
 	for {
-		_, message, err := c.conn.ReadMessage()
-		if err != nil {
+		message, err := c.readFrame(config.MaxMessageSize)
+		if errors.Is(err, errMessageTooLarge) {
+			c.sendError("", ErrorCodeMessageTooLarge, "Frame exceeds the maximum size of "+strconv.FormatInt(config.MaxMessageSize, 10)+" bytes")
+			continue
+		} else if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			return
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		if c.codec.MessageType() == websocket.TextMessage {
+			message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		}
 
-		var incomingEvent IncomingEvent
+		c.Hub.presence.active(c)
+		idleTimer.Reset(idleTimeout)
 
-		if err := json.Unmarshal(message, &incomingEvent); err != nil {
+		var envelope incomingEnvelope
+		if err := c.codec.Unmarshal(message, &envelope); err != nil {
 			log.Printf("Could not process message: %v", err)
+			c.sendError("", ErrorCodeBadRequest, "Frame is not a valid envelope")
 			continue
 		}
 
-		if c.isAuthenticated {
-			switch incomingEvent.RequestType {
-			case AddMessage:
-				outgoingEvent, err := c.chatService.AddMessage(incomingEvent)
-				if err != nil {
-					continue
-				}
+		if envelope.Version != ProtocolVersion {
+			c.sendError(envelope.Id, ErrorCodeUnsupportedVersion, "Protocol version "+strconv.Itoa(ProtocolVersion)+" is required")
+			continue
+		}
 
-				outgoingEvent.Client = c
-				c.Hub.send <- outgoingEvent
-			case AddParticipant:
-				outgoingEvent, err := c.chatService.AddParticipant(incomingEvent)
-				if err != nil {
-					continue
-				}
+		incomingEvent := envelope.Payload
+		incomingEvent.Type = envelope.Type
 
-				outgoingEvent.Client = c
-				c.Hub.send <- outgoingEvent
-			case RemoveMessage:
-			case RemoveParticipant:
+		c.handle(envelope.Id, incomingEvent)
+	}
+}
 
-			}
-		} else if incomingEvent.RequestType == Authenticate {
-			token, err := auth.VerifyIDToken(ctx, incomingEvent.Token)
-			if err != nil {
-				errMessage, _ := json.Marshal("Token not valid.")
-				c.send <- errMessage
-				return
-			} else if token.UID != c.id {
-				errMessage, _ := json.Marshal("Token does not match Client uid")
-				c.send <- errMessage
-				return
-			}
-			c.isAuthenticated = true
-			// Stops disconnect timer when user is authenticated
-			if !disconnectTimer.Stop() {
-				<-disconnectTimer.C
-			}
+// readFrame reads the next message from the peer. Messages larger than limit are
+// discarded so the connection can be kept open.
+func (c *Client) readFrame(limit int64) ([]byte, error) {
+	_, r, err := c.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(message)) > limit {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return nil, err
+		}
+		return nil, errMessageTooLarge
+	}
+
+	return message, nil
+}
+
+// handle processes a request of the Client. Every request is answered
+// with an ack frame carrying the resulting event, or an error frame.
+func (c *Client) handle(requestId string, incomingEvent IncomingEvent) {
+	var outgoingEvent OutgoingEvent
+	var err error
+
+	switch incomingEvent.Type {
+	case AddMessage:
+		outgoingEvent, err = c.chatService.AddMessage(incomingEvent, c.id)
+	case AddParticipant:
+		outgoingEvent, err = c.chatService.AddParticipant(incomingEvent, c.id)
+	case RemoveMessage:
+		outgoingEvent, err = c.chatService.RemoveMessage(incomingEvent, c.id)
+	case EditMessage:
+		outgoingEvent, err = c.chatService.EditMessage(incomingEvent, c.id)
+	case ReadMessages:
+		outgoingEvent, err = c.chatService.MarkConversationAsRead(incomingEvent, c.id)
+	case AddReaction:
+		outgoingEvent, err = c.chatService.AddReaction(incomingEvent, c.id)
+	case RemoveReaction:
+		outgoingEvent, err = c.chatService.RemoveReaction(incomingEvent, c.id)
+	case RemoveParticipant:
+		outgoingEvent, err = c.chatService.RemoveParticipant(incomingEvent, c.id)
+	case TypingStarted:
+		// Typing indicators are relayed without being persisted
+		if err = c.startTyping(incomingEvent.ConversationId); err == nil {
+			c.sendAck(requestId, nil)
+			return
+		}
+	case TypingStopped:
+		c.stopTyping(incomingEvent.ConversationId, nil)
+		c.sendAck(requestId, nil)
+		return
+	case Subscribe:
+		c.subscribe(requestId, incomingEvent.ConversationIds)
+		return
+	case Unsubscribe:
+		c.unsubscribe(requestId, incomingEvent.ConversationIds)
+		return
+	case Authenticate:
+		c.reauthenticate(requestId, incomingEvent.Token)
+		return
+	case Sync:
+		// Missed events are replayed in the ack before live delivery resumes
+		select {
+		case c.Hub.hold <- c:
+		case <-c.Hub.done:
+			return
+		}
+		c.replay(requestId, incomingEvent.Cursors, false)
+		return
+	default:
+		c.sendError(requestId, ErrorCodeUnsupportedType, "Unsupported frame type "+incomingEvent.Type)
+		return
+	}
 
+	if err != nil {
+		code := errorCode(err)
+		message := err.Error()
+		if code == ErrorCodeInternal {
+			log.Printf("Unable to process %s request: %v", incomingEvent.Type, err)
+			message = "Unable to process request"
 		}
+		c.sendError(requestId, code, message)
+		return
+	}
+
+	// Retried messages were already delivered by the first attempt
+	if !outgoingEvent.Duplicate {
+		outgoingEvent.Client = c
+		c.Hub.Send(outgoingEvent)
+	}
+	c.sendAck(requestId, outgoingEvent)
+
+	// New members receive the conversation so it shows up in their list
+	if len(outgoingEvent.AddedParticipants) > 0 {
+		c.sendConversationAdded(outgoingEvent.ConversationId, outgoingEvent.AddedParticipants)
+	}
+}
+
+// sendConversationAdded notifies users about a conversation they joined.
+func (c *Client) sendConversationAdded(conversationId string, userIds []string) {
+	outgoingEvents, err := c.chatService.GetConversationAddedEvents(conversationId, userIds)
+	if err != nil {
+		log.Printf("Unable to get conversation %s for new participants: %v", conversationId, err)
+	}
+
+	for _, outgoingEvent := range outgoingEvents {
+		c.Hub.Send(outgoingEvent)
 	}
 }
 
@@ -187,43 +324,58 @@ func (c *Client) ReadPump() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	config := c.Hub.config
+	ticker := time.NewTicker(config.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		_ = c.conn.Close()
+		c.Hub.writers.Done()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+		case <-c.outbox.ready:
+			messages, closed := c.outbox.drain()
+			if err := c.write(config, messages); err != nil {
 				return
 			}
-			_, _ = w.Write(message)
 
-			// Add queued chat messages to the current ws message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				_, _ = w.Write(newline)
-				_, _ = w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			if closed {
+				// The hub closed the outbox.
+				code, reason := c.outbox.closeMessage()
+				var message []byte
+				if code != 0 {
+					message = websocket.FormatCloseMessage(code, reason)
+				}
+				_ = c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+				_ = c.conn.WriteMessage(websocket.CloseMessage, message)
 				return
 			}
 		case <-ticker.C:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			_ = c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
+
+// write sends queued messages to the peer. Text messages are joined into a single
+// ws message; binary frames cannot be delimited, so they are sent one per message.
+func (c *Client) write(config config.Websocket, messages [][]byte) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	if c.codec.MessageType() == websocket.TextMessage {
+		messages = [][]byte{bytes.Join(messages, newline)}
+	}
+
+	for _, message := range messages {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
+		if err := c.conn.WriteMessage(c.codec.MessageType(), message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
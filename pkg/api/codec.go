@@ -0,0 +1,104 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes the frames of a websocket subprotocol.
+//
+// Frames are described once by Envelope, IncomingEvent and OutgoingEvent and
+// their json tags; every codec derives its wire format from those tags.
+type Codec interface {
+	// Subprotocol negotiated through the Sec-WebSocket-Protocol header.
+	Subprotocol() string
+
+	// MessageType is the websocket message type used for encoded frames.
+	MessageType() int
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec    Codec = jsonCodec{subprotocol: "chat.v1.json"}
+	MsgpackCodec Codec = msgpackCodec{}
+
+	// Subprotocol predates codec negotiation and speaks JSON.
+	legacyJSONCodec Codec = jsonCodec{subprotocol: Subprotocol}
+)
+
+// Codecs lists the codecs in order of preference.
+var Codecs = []Codec{JSONCodec, MsgpackCodec, legacyJSONCodec}
+
+// Subprotocols returns the subprotocols of all supported codecs.
+func Subprotocols() []string {
+	subprotocols := make([]string, len(Codecs))
+	for i, codec := range Codecs {
+		subprotocols[i] = codec.Subprotocol()
+	}
+	return subprotocols
+}
+
+// CodecFor returns the codec of a negotiated subprotocol. Connections without a
+// subprotocol use JSON.
+func CodecFor(subprotocol string) (Codec, bool) {
+	if subprotocol == "" {
+		return JSONCodec, true
+	}
+	for _, codec := range Codecs {
+		if codec.Subprotocol() == subprotocol {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+type jsonCodec struct {
+	subprotocol string
+}
+
+func (c jsonCodec) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (jsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec encodes frames as MessagePack using the json tags as field names.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string {
+	return "chat.v1.msgpack"
+}
+
+func (msgpackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
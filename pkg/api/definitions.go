@@ -5,9 +5,20 @@ import (
 	"time"
 )
 
+// Types of conversations. Conversations between two users are one-to-one, larger
+// ones are groups.
+const (
+	OneToOneConversation = "ONE_TO_ONE"
+	GroupConversation    = "GROUP"
+)
+
 type ConversationDoc struct {
 	Participants []string `firestore:"participants"`
 	Type         string   `firestore:"type"`
+	Sequence     int64    `firestore:"sequence"`
+
+	// User that created the conversation, allowed to remove other participants
+	CreatedBy string `firestore:"createdBy,omitempty"`
 }
 
 type NewConversation struct {
@@ -16,25 +27,70 @@ type NewConversation struct {
 }
 
 type Conversation struct {
-	Id           string    `json:"id"`
-	Participants []User    `json:"participants"`
-	Type         string    `json:"type"`
-	Messages     []Message `json:"messages"`
-	UnreadCount  int       `json:"unreadCount"`
+	Id           string        `json:"id"`
+	Participants []User        `json:"participants"`
+	Type         string        `json:"type"`
+	Messages     []Message     `json:"messages"`
+	UnreadCount  int           `json:"unreadCount"`
+	ReadReceipts []ReadReceipt `json:"readReceipts,omitempty"`
 }
 
 type UserConversation struct {
-	UnreadCount     int                    `firestore:"unreadCount" json:"unreadCount"`
-	ConversationRef *firestore.DocumentRef `firestore:"conversationRef" json:"conversationRef"`
+	UnreadCount       int                    `firestore:"unreadCount" json:"unreadCount"`
+	ConversationRef   *firestore.DocumentRef `firestore:"conversationRef" json:"conversationRef"`
+	LastReadMessageId string                 `firestore:"lastReadMessageId,omitempty" json:"lastReadMessageId,omitempty"`
+	LastReadAt        *time.Time             `firestore:"lastReadAt,omitempty" json:"lastReadAt,omitempty"`
+}
+
+type ReadReceipt struct {
+	UserId            string     `json:"userId"`
+	LastReadMessageId string     `json:"lastReadMessageId,omitempty"`
+	LastReadAt        *time.Time `json:"lastReadAt,omitempty"`
 }
 
 type Message struct {
-	Id          string    `firestore:"id,omitempty" json:"id,omitempty"`
-	SenderId    string    `firestore:"senderId" json:"senderId"`
-	ContentType string    `firestore:"contentType" json:"contentType"`
-	Body        string    `firestore:"body" json:"body,omitempty"`
-	CreatedAt   time.Time `firestore:"createdAt" json:"createdAt,omitempty"`
-	Attachments []string  `firestore:"attachments,omitempty" json:"attachments,omitempty"`
+	Id                 string              `firestore:"id,omitempty" json:"id,omitempty"`
+	SenderId           string              `firestore:"senderId" json:"senderId"`
+	ContentType        string              `firestore:"contentType" json:"contentType"`
+	Body               string              `firestore:"body" json:"body,omitempty"`
+	CreatedAt          time.Time           `firestore:"createdAt" json:"createdAt,omitempty"`
+	Attachments        []string            `firestore:"attachments,omitempty" json:"attachments,omitempty"`
+	EditedAt           *time.Time          `firestore:"editedAt,omitempty" json:"editedAt,omitempty"`
+	DeletedAt          *time.Time          `firestore:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	DeletedBy          string              `firestore:"deletedBy,omitempty" json:"deletedBy,omitempty"`
+	Reactions          map[string]Reaction `firestore:"reactions,omitempty" json:"reactions,omitempty"`
+	ParentMessageId    string              `firestore:"parentMessageId,omitempty" json:"parentMessageId,omitempty"`
+	ReplyCount         int                 `firestore:"replyCount,omitempty" json:"replyCount,omitempty"`
+	LastReplyAt        *time.Time          `firestore:"lastReplyAt,omitempty" json:"lastReplyAt,omitempty"`
+	ThreadParticipants []string            `firestore:"threadParticipants,omitempty" json:"-"`
+	Sequence           int64               `firestore:"sequence,omitempty" json:"sequence,omitempty"`
+	ClientKey          string              `firestore:"clientKey,omitempty" json:"clientKey,omitempty"`
+}
+
+type Thread struct {
+	Root        Message   `json:"root"`
+	Replies     []Message `json:"replies"`
+	UnreadCount int       `json:"unreadCount"`
+}
+
+type UserThread struct {
+	UnreadCount int `firestore:"unreadCount"`
+}
+
+type Reaction struct {
+	Count   int      `firestore:"count" json:"count"`
+	UserIds []string `firestore:"userIds" json:"userIds"`
+}
+
+type Announcement struct {
+	Id        string    `firestore:"-" json:"id"`
+	Title     string    `firestore:"title" json:"title"`
+	Body      string    `firestore:"body" json:"body"`
+	Severity  string    `firestore:"severity" json:"severity"`
+	UserIds   []string  `firestore:"userIds" json:"userIds,omitempty"`
+	CreatedAt time.Time `firestore:"createdAt" json:"createdAt"`
+	CreatedBy string    `firestore:"createdBy" json:"createdBy,omitempty"`
+	ExpiresAt time.Time `firestore:"expiresAt" json:"expiresAt"`
 }
 
 type User struct {
@@ -50,20 +106,56 @@ type User struct {
 	LastActivity time.Time `json:"lastActivity"`
 }
 
+type UserPresence struct {
+	UserId       string    `json:"userId"`
+	Status       string    `json:"status"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// ConversationActivity summarizes a message event of a conversation the Client is
+// not subscribed to.
+type ConversationActivity struct {
+	Type            string `json:"type"`
+	MessageId       string `json:"messageId,omitempty"`
+	ParentMessageId string `json:"parentMessageId,omitempty"`
+	SenderId        string `json:"senderId,omitempty"`
+	Sequence        int64  `json:"sequence,omitempty"`
+}
+
 type IncomingEvent struct {
-	ConversationId string   `json:"conversationId,omitempty"`
-	RequestType    int      `json:"requestType,omitempty"`
-	Message        *Message `json:"message,omitempty"`
-	Participants   []string `json:"participants,omitempty"`
-	Token          string   `json:"token,omitempty"`
+	ConversationId  string           `json:"conversationId,omitempty"`
+	Type            string           `json:"-"`
+	Message         *Message         `json:"message,omitempty"`
+	Participants    []string         `json:"participants,omitempty"`
+	Token           string           `json:"token,omitempty"`
+	Reaction        string           `json:"reaction,omitempty"`
+	Cursors         map[string]int64 `json:"cursors,omitempty"`
+	ConversationIds []string         `json:"conversationIds,omitempty"`
 }
 
 type OutgoingEvent struct {
-	ConversationId string   `json:"conversationId,omitempty"`
-	RequestType    int      `json:"requestType,omitempty"`
-	Message        *Message `json:"message,omitempty"`
-	Participants   []string `json:"participants,omitempty"`
-	Client         *Client
+	ConversationId      string                `json:"conversationId,omitempty"`
+	Type                string                `json:"-"`
+	Message             *Message              `json:"message,omitempty"`
+	Participants        []string              `json:"participants,omitempty"`
+	AddedParticipants   []string              `json:"addedParticipants,omitempty"`
+	RemovedParticipants []string              `json:"removedParticipants,omitempty"`
+	UserId              string                `json:"userId,omitempty"`
+	ReadReceipt         *ReadReceipt          `json:"readReceipt,omitempty"`
+	Presence            *UserPresence         `json:"presence,omitempty"`
+	Activity            *ConversationActivity `json:"activity,omitempty"`
+	Announcement        *Announcement         `json:"announcement,omitempty"`
+	Conversation        *Conversation         `json:"conversation,omitempty"`
+	Reaction            string                `json:"reaction,omitempty"`
+	Client              *Client               `json:"-"`
+
+	// Position of the event in its conversation's event log, shared with the
+	// sequence of messages. Events that are not persisted have none.
+	Sequence int64 `json:"sequence,omitempty"`
+
+	// Set when a retried message was already stored. Such events are acknowledged
+	// without being delivered again.
+	Duplicate bool `json:"-"`
 }
 
 type UserModel struct {
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Close reason sent to clients when the server shuts down.
+const goingAwayReason = "Server shutting down"
+
+// GoingAwayNotice is the payload of the frame sent to clients before the server
+// closes their connection on shutdown.
+type GoingAwayNotice struct {
+	// Milliseconds to wait before reconnecting, spread out so clients do not all
+	// reconnect at once
+	ReconnectAfter int64 `json:"reconnectAfter"`
+}
+
+// Draining reports whether the Hub is shutting down and rejects new connections.
+func (h *Hub) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// Shutdown stops accepting connections, tells every connected Client to reconnect
+// after reconnectAfter, writes their queued frames and stops the Hub along with its
+// presence tracking and backplane consumer. Connections still open when ctx is done
+// are closed without flushing.
+func (h *Hub) Shutdown(ctx context.Context, reconnectAfter time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&h.draining, 0, 1) {
+		return nil
+	}
+
+	clients := make(chan []*Client, 1)
+	select {
+	case h.stop <- stopRequest{reconnectAfter: reconnectAfter, clients: clients}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	closedClients := <-clients
+
+	// WritePumps exit once they wrote the queued frames and the close message, and
+	// presence tracking once it published the statuses of the closed connections
+	flushed := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		<-h.presence.stopped
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		for _, client := range closedClients {
+			if client.conn != nil {
+				_ = client.conn.Close()
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// stopRequest asks the Hub goroutine to close every Client and stop.
+type stopRequest struct {
+	reconnectAfter time.Duration
+
+	// Receives the clients that were closed
+	clients chan []*Client
+}
+
+// stopClients sends the going-away frame to every Client, closes their outboxes
+// and returns the closed clients.
+func (h *Hub) stopClients(stop stopRequest) []*Client {
+	var clients []*Client
+	for _, registered := range h.clients {
+		clients = append(clients, registered...)
+	}
+
+	for _, client := range clients {
+		notice := GoingAwayNotice{ReconnectAfter: jitter(stop.reconnectAfter).Milliseconds()}
+
+		// Without the going-away frame the close reason carries the reconnect delay
+		reason := goingAwayReason
+		message, err := encodeFrame(client.codec, GoingAway, "", notice)
+		if err != nil {
+			log.Printf("Could not process going away frame: %v", err)
+			reason = goingAwayCloseReason(notice)
+		} else if client.outbox.push(frame{data: message, control: true}) == pushOverflow {
+			log.Printf("Outbox of session %s of user %s is full, closing without going away frame", client.sessionId, client.id)
+			reason = goingAwayCloseReason(notice)
+		}
+
+		h.removeClient(client, websocket.CloseServiceRestart, reason)
+	}
+
+	log.Printf("Closed %d websocket connections", len(clients))
+	return clients
+}
+
+// goingAwayCloseReason returns the close reason of a Client that could not be sent
+// the going-away frame, with the milliseconds to wait before reconnecting.
+func goingAwayCloseReason(notice GoingAwayNotice) string {
+	return goingAwayReason + ", reconnect after " + strconv.FormatInt(notice.ReconnectAfter, 10) + "ms"
+}
+
+// jitter returns a duration between d and twice d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d + time.Duration(rand.Int63n(int64(d)))
+}
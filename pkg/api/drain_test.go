@@ -0,0 +1,43 @@
+package api
+
+import (
+	"chatService/config"
+	"github.com/gorilla/websocket"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStopClients(t *testing.T) {
+	h := NewHub(NewPresenceTracker(nil, nil), config.Websocket{}, NewMemoryBackplane())
+
+	client := &Client{id: "me", codec: JSONCodec, outbox: newOutbox(2, config.DropOldest)}
+
+	// Control frames are never dropped, so a full outbox has no room left
+	full := &Client{id: "friend", codec: JSONCodec, outbox: newOutbox(1, config.DropOldest)}
+	full.outbox.push(frame{data: []byte("ack"), control: true})
+
+	h.clients = map[string][]*Client{"me": {client}, "friend": {full}}
+	h.stopClients(stopRequest{reconnectAfter: time.Second})
+
+	messages, closed := client.outbox.drain()
+	if !closed || len(messages) != 1 || !strings.Contains(string(messages[0]), GoingAway) {
+		t.Errorf("frames = %q, closed = %v, want the going away frame", messages, closed)
+	}
+	if code, reason := client.outbox.closeMessage(); code != websocket.CloseServiceRestart || reason != goingAwayReason {
+		t.Errorf("close = %d %q, want %d %q", code, reason, websocket.CloseServiceRestart, goingAwayReason)
+	}
+
+	messages, closed = full.outbox.drain()
+	if !closed || len(messages) != 1 || string(messages[0]) != "ack" {
+		t.Errorf("frames = %q, closed = %v, want the queued ack", messages, closed)
+	}
+	code, reason := full.outbox.closeMessage()
+	if code != websocket.CloseServiceRestart || !strings.HasPrefix(reason, goingAwayReason+", reconnect after ") {
+		t.Errorf("close = %d %q, want %d with the reconnect delay", code, reason, websocket.CloseServiceRestart)
+	}
+
+	if len(h.clients) != 0 {
+		t.Errorf("clients = %v, want none", h.clients)
+	}
+}
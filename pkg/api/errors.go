@@ -0,0 +1,23 @@
+package api
+
+import "errors"
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrForbidden            = errors.New("user is not allowed to perform this request")
+	ErrInvalidMessage       = errors.New("message is missing")
+	ErrMessageNotFound      = errors.New("message not found")
+	ErrNotMessageSender     = errors.New("only the sender can modify this message")
+	ErrNotParticipant       = errors.New("user is not a participant of this conversation")
+	ErrOneToOneConversation = errors.New("participants cannot be removed from one-to-one conversations")
+	ErrNotConversationOwner = errors.New("only the creator of the conversation can remove other participants")
+	ErrConversationExists   = errors.New("a one-to-one conversation with these participants already exists")
+	ErrInvalidReaction      = errors.New("reaction is empty or too long")
+	ErrInvalidClientKey     = errors.New("client key is too long")
+	ErrInvalidAnnouncement  = errors.New("announcement needs a title, a body, a known severity and a future expiry")
+	ErrAnnouncementNotFound = errors.New("announcement not found")
+
+	// Returned while reading a frame that exceeds the configured limit
+	errMessageTooLarge = errors.New("frame exceeds the maximum message size")
+)
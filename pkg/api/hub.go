@@ -1,127 +1,398 @@
 package api
 
 import (
-	"encoding/json"
+	"chatService/config"
+	"github.com/gorilla/websocket"
 	"log"
+	"sync"
+	"time"
 )
 
+// Close reason sent to clients that cannot keep up with their frames.
+const slowConsumerReason = "Client too slow"
+
 // Hub maintains the set of active clients and broadcasts messages to the clients.
 type Hub struct {
 	// Registered clients.
 	clients map[string][]*Client
 
-	// Inbound message to all clients.
-	broadcast chan []byte
+	// Inbound events to all clients, or to the participants listed in the event.
+	broadcast chan OutgoingEvent
 
 	// Register requests from the clients.
-	Register chan *Client
+	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
 
 	// Inbound message to specified clients.
 	send chan OutgoingEvent
+
+	// Clients whose live events are held back while missed events are fetched.
+	hold chan *Client
+
+	// Replayed events of clients catching up after reconnecting.
+	resume chan replay
+
+	// Inbound frames for a single Client, such as acks and errors.
+	direct chan directMessage
+
+	// Changes to the conversations clients are subscribed to.
+	subscribe chan subscription
+
+	// Tracks the presence of users based on their connections.
+	presence *PresenceTracker
+
+	// Limits and timeouts of the websocket connections.
+	config config.Websocket
+
+	// Identifies the Hub on the backplane.
+	id string
+
+	// Relays events between the hubs of all server instances.
+	backplane Backplane
+
+	// Inbound events published by other server instances.
+	relay chan backplaneEvent
+
+	// Functions inspecting or modifying the clients on behalf of the admin API.
+	inspection chan func()
+
+	// Receive-only clients marked active by requests of their users.
+	streams streamActivity
+
+	// Counters exposed through the admin API.
+	stats HubStats
+
+	// Set once Shutdown is called, new connections are rejected from then on.
+	draining int32
+
+	// Request to close every Client and stop the Hub.
+	stop chan stopRequest
+
+	// Closed when the Hub stopped, so senders no longer wait for it.
+	done chan struct{}
+
+	// WritePumps of registered clients that have not exited yet.
+	writers sync.WaitGroup
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
+func NewHub(presence *PresenceTracker, config config.Websocket, backplane Backplane) *Hub {
+	hub := &Hub{
+		broadcast:  make(chan OutgoingEvent),
 		send:       make(chan OutgoingEvent),
-		Register:   make(chan *Client),
+		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		hold:       make(chan *Client),
+		resume:     make(chan replay),
+		direct:     make(chan directMessage),
+		subscribe:  make(chan subscription),
 		clients:    make(map[string][]*Client),
+		presence:   presence,
+		config:     config,
+		id:         newId(),
+		backplane:  backplane,
+		relay:      make(chan backplaneEvent),
+		inspection: make(chan func()),
+		stop:       make(chan stopRequest),
+		done:       make(chan struct{}),
+	}
+	hub.stats = HubStats{Instance: hub.id, StartedAt: time.Now()}
+	presence.hub = hub
+
+	return hub
+}
+
+// directMessage is a frame addressed to a single Client.
+type directMessage struct {
+	client  *Client
+	message []byte
+
+	// Whether the frame answers the peer and must not be dropped
+	control bool
+}
+
+// Send queues an event for delivery to the participants listed in the event.
+func (h *Hub) Send(outgoingEvent OutgoingEvent) {
+	select {
+	case h.send <- outgoingEvent:
+	case <-h.done:
+	}
+}
+
+// Register adds a Client to the Hub. It reports false when the Hub stopped, in
+// which case the connection must be closed.
+func (h *Hub) Register(client *Client) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// sendDirect queues a frame for a single Client.
+func (h *Hub) sendDirect(client *Client, message []byte) {
+	select {
+	case h.direct <- directMessage{client: client, message: message}:
+	case <-h.done:
+	}
+}
+
+// sendControl queues a control frame for a single Client, such as an ack or an
+// error. Control frames are never dropped by the slow-consumer policy.
+func (h *Hub) sendControl(client *Client, message []byte) {
+	select {
+	case h.direct <- directMessage{client: client, message: message, control: true}:
+	case <-h.done:
 	}
 }
 
 func (h *Hub) Run() {
+	messages, err := h.backplane.Subscribe()
+	if err != nil {
+		log.Printf("Unable to subscribe to backplane, events stay on this instance: %v", err)
+	} else {
+		go h.consume(messages)
+	}
+
 	for {
 		select {
 		// Register Client
-		case client := <-h.Register:
+		case client := <-h.register:
 			h.clients[client.id] = append(h.clients[client.id], client)
+			h.writers.Add(1)
+			h.stats.ConnectionsOpened++
+			h.presence.connect(client)
+			if client.activity != nil {
+				h.streams.add(client)
+			}
 		// Unregister Client
 		case client := <-h.unregister:
-			// Check if Client with uid exists
-			if _, ok := h.clients[client.id]; ok {
-				// Search for Client that matches Client reference
-				for i := 0; i < len(h.clients[client.id]); i++ {
-					// If Client found then removing from array
-					if client == h.clients[client.id][i] {
-						length := len(h.clients[client.id]) - 1
-
-						// Remove element at position i
-						h.clients[client.id][i] = h.clients[client.id][length]
-						h.clients[client.id][length] = nil
-						h.clients[client.id] = h.clients[client.id][:length]
-
-						// If no clients exist with id then remove key from clients map
-						if len(h.clients[client.id]) == 0 {
-							delete(h.clients, client.id)
-						}
-						break
-					}
-				}
-				close(client.send)
-			}
+			h.removeClient(client, 0, "")
 		// Send message to all clients
-		case message := <-h.broadcast:
-			for uid := range h.clients {
-				for i, client := range h.clients[uid] {
-					select {
-					case client.send <- message:
-					default:
-						close(client.send)
-
-						length := len(h.clients[client.id]) - 1
-
-						// Remove element at position i
-						h.clients[client.id][i] = h.clients[client.id][length]
-						h.clients[client.id][length] = nil
-						h.clients[client.id] = h.clients[client.id][:length]
-
-						// If no clients exist with id then remove key from clients map
-						if len(h.clients[uid]) == 0 {
-							delete(h.clients, uid)
-						}
-					}
-				}
+		case outgoingEvent := <-h.broadcast:
+			h.stats.EventsSent++
+			h.broadcastEvent(outgoingEvent)
+			h.publish(outgoingEvent, true)
+		// Hold back live events of a Client that is catching up
+		case client := <-h.hold:
+			client.replaying = true
+			if client.backlog == nil {
+				client.backlog = newOutbox(client.outbox.capacity, client.outbox.policy)
+			}
+		// Deliver missed events to a reconnected Client
+		case replay := <-h.resume:
+			h.resumeClient(replay)
+		// Change the conversations a Client focuses on
+		case subscription := <-h.subscribe:
+			h.updateSubscriptions(subscription)
+		// Send frame to a single Client
+		case direct := <-h.direct:
+			if !h.enqueue(direct.client, frame{data: direct.message, control: direct.control}) {
+				h.dropSlowClients([]*Client{direct.client})
 			}
 		// Send message to all participants of a conversation
 		case outgoingEvent := <-h.send:
-			currentClient := outgoingEvent.Client
-			outgoingEvent.Client = nil
+			h.stats.EventsSent++
+			h.deliver(outgoingEvent)
+			h.publish(outgoingEvent, false)
+		// Send event published by another instance
+		case event := <-h.relay:
+			if event.Disconnect != nil {
+				h.disconnect(*event.Disconnect)
+				continue
+			}
+			if event.ActiveUserId != "" {
+				h.streams.signal(event.ActiveUserId)
+				continue
+			}
+			h.stats.EventsRelayed++
+			event.Event.Type = event.Type
+			if event.Broadcast {
+				h.broadcastEvent(event.Event)
+			} else {
+				h.deliver(event.Event)
+			}
+		// Inspect clients for the admin API
+		case fn := <-h.inspection:
+			fn()
+		// Close every Client and stop
+		case stop := <-h.stop:
+			stop.clients <- h.stopClients(stop)
+			close(h.done)
+			return
+		}
+	}
+}
 
-			message, err := json.Marshal(outgoingEvent)
-			if err != nil {
-				log.Printf("Could not process outgoing message: %v", err)
+// deliver sends an event to the connected clients of its participants, skipping
+// the Client that caused it.
+func (h *Hub) deliver(outgoingEvent OutgoingEvent) {
+	currentClient := outgoingEvent.Client
+	outgoingEvent.Client = nil
+
+	h.refreshSubscriptions(outgoingEvent)
+
+	// Encode the event and its summary once per codec used by the receiving clients
+	messages := make(map[Codec][]byte)
+	summaries := make(map[Codec][]byte)
+
+	// Clients are removed once all participants were served
+	var slowClients []*Client
+
+	// Send message to all participants of conversation
+	for _, uid := range outgoingEvent.Participants {
+		for _, client := range h.clients[uid] {
+			if client == currentClient {
+				continue
 			}
 
-			// Send message to all participants of conversation
-			for _, uid := range outgoingEvent.Participants {
-				for i, client := range h.clients[uid] {
-					if currentClient != client {
-						select {
-						case client.send <- message:
-						default:
-							close(client.send)
-
-							length := len(h.clients[client.id]) - 1
-
-							// Remove element at position i
-							h.clients[client.id][i] = h.clients[client.id][length]
-							h.clients[client.id][length] = nil
-							h.clients[client.id] = h.clients[client.id][:length]
-
-							// If no clients exist with id then remove key from clients map
-							if len(h.clients[uid]) == 0 {
-								delete(h.clients, uid)
-							}
-						}
-					}
-
-				}
+			var message []byte
+			var key string
+			switch deliveryFor(client, outgoingEvent) {
+			case deliverEvent:
+				message = encodeCached(messages, client.codec, outgoingEvent)
+				key = coalesceKey(outgoingEvent)
+			case deliverSummary:
+				summary := summarize(outgoingEvent)
+				message = encodeCached(summaries, client.codec, summary)
+				key = coalesceKey(summary)
+			}
+			if message == nil {
+				continue
 			}
+
+			f := frame{
+				data:           message,
+				key:            key,
+				conversationId: outgoingEvent.ConversationId,
+				sequence:       outgoingEvent.Sequence,
+			}
+			if !h.queue(client, f) {
+				slowClients = append(slowClients, client)
+			}
+		}
+	}
+
+	h.dropSlowClients(slowClients)
+}
+
+// queue queues a live frame for a Client. Live frames are held back until missed
+// events have been replayed; the held back frames are bounded like the outbox.
+// It reports false when the Client must be disconnected.
+func (h *Hub) queue(client *Client, f frame) bool {
+	if client.replaying {
+		return h.record(client.backlog.push(f))
+	}
+	return h.enqueue(client, f)
+}
+
+// enqueue queues a frame in the outbox of a Client and records what the
+// slow-consumer policy did. It reports false when the Client must be disconnected.
+func (h *Hub) enqueue(client *Client, f frame) bool {
+	return h.record(client.outbox.push(f))
+}
+
+// record counts the result of queueing a frame. It reports false when the queue
+// overflowed.
+func (h *Hub) record(result pushResult) bool {
+	switch result {
+	case pushQueued:
+		h.stats.FramesQueued++
+	case pushCoalesced:
+		h.stats.FramesQueued++
+		h.stats.FramesCoalesced++
+	case pushDropped:
+		h.stats.FramesQueued++
+		h.stats.FramesDropped++
+	case pushOverflow:
+		return false
+	}
+	return true
+}
+
+// dropSlowClients disconnects clients whose send queue overflowed, so they
+// reconnect and catch up with a sync request.
+func (h *Hub) dropSlowClients(clients []*Client) {
+	for _, client := range clients {
+		log.Printf("Disconnecting slow session %s of user %s", client.sessionId, client.id)
+		if h.removeClient(client, websocket.CloseTryAgainLater, slowConsumerReason) {
+			h.stats.ClientsDropped++
+		}
+	}
+}
+
+// coalesceKey identifies events superseded by newer events with the same key,
+// such as consecutive presence changes of a user. Other events have no key.
+func coalesceKey(outgoingEvent OutgoingEvent) string {
+	switch outgoingEvent.Type {
+	case TypingStarted, TypingStopped:
+		return "typing:" + outgoingEvent.ConversationId + ":" + outgoingEvent.UserId
+	case PresenceChanged:
+		return "presence:" + outgoingEvent.UserId
+	case ReadMessages:
+		if outgoingEvent.ReadReceipt != nil {
+			return "read:" + outgoingEvent.ConversationId + ":" + outgoingEvent.ReadReceipt.UserId
+		}
+	case Activity:
+		return "activity:" + outgoingEvent.ConversationId
+	}
+	return ""
+}
+
+// encodeCached encodes an event with a codec, reusing earlier encodings of the event.
+func encodeCached(cache map[Codec][]byte, codec Codec, outgoingEvent OutgoingEvent) []byte {
+	if message, ok := cache[codec]; ok {
+		return message
+	}
+
+	message, err := encodeEvent(codec, outgoingEvent)
+	if err != nil {
+		log.Printf("Could not process outgoing message: %v", err)
+	}
+	cache[codec] = message
+
+	return message
+}
+
+// isRegistered reports whether the Client is still registered with the Hub.
+func (h *Hub) isRegistered(client *Client) bool {
+	for _, registered := range h.clients[client.id] {
+		if registered == client {
+			return true
 		}
+	}
+	return false
+}
+
+// removeClient unregisters a Client and closes its outbox, which stops its
+// WritePump once the queued frames are written. A non-zero close code is sent to
+// the peer. It reports whether the Client was registered.
+func (h *Hub) removeClient(client *Client, closeCode int, closeReason string) bool {
+	client.outbox.close(closeCode, closeReason)
+
+	for i, registered := range h.clients[client.id] {
+		if registered == client {
+			length := len(h.clients[client.id]) - 1
 
+			// Remove element at position i
+			h.clients[client.id][i] = h.clients[client.id][length]
+			h.clients[client.id][length] = nil
+			h.clients[client.id] = h.clients[client.id][:length]
+
+			// If no clients exist with id then remove key from clients map
+			if len(h.clients[client.id]) == 0 {
+				delete(h.clients, client.id)
+			}
+
+			h.stats.ConnectionsClosed++
+			h.presence.disconnect(client)
+			if client.activity != nil {
+				h.streams.remove(client)
+			}
+			return true
+		}
 	}
+	return false
 }
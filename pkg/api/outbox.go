@@ -0,0 +1,212 @@
+package api
+
+import (
+	"chatService/config"
+	"sync"
+)
+
+// Result of queueing a frame in an outbox.
+type pushResult int
+
+const (
+	pushQueued pushResult = iota
+	pushCoalesced
+	pushDropped
+	pushOverflow
+	pushClosed
+)
+
+// frame is an encoded frame waiting to be written to the peer.
+type frame struct {
+	data []byte
+
+	// Frames with the same non-empty key supersede each other
+	key string
+
+	// Control frames answer the peer, such as acks and errors, and are never dropped
+	control bool
+
+	// Conversation and sequence of the persisted event carried by the frame, so
+	// frames held back during a replay are skipped when the replay covers them
+	conversationId string
+	sequence       int64
+}
+
+// outbox is the bounded queue of frames written to a Client by its WritePump.
+// The Hub queues frames without ever blocking on a slow peer; the policy decides
+// what happens once the queue is full.
+type outbox struct {
+	frames   []frame
+	capacity int
+	policy   string
+
+	// Signals the WritePump that frames were queued or the outbox was closed
+	ready chan struct{}
+
+	// Close code and reason written to the peer once the outbox is drained
+	closed      bool
+	closeCode   int
+	closeReason string
+
+	// Frames dropped or replaced because the queue was full
+	dropped   int64
+	coalesced int64
+
+	mutex sync.Mutex
+}
+
+func newOutbox(capacity int, policy string) *outbox {
+	return &outbox{
+		capacity: capacity,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push queues a frame, applying the policy when the queue is full.
+func (o *outbox) push(f frame) pushResult {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed {
+		return pushClosed
+	}
+
+	result := pushQueued
+	if o.policy == config.Coalesce && f.key != "" {
+		if i := o.indexOf(f.key); i >= 0 {
+			// The superseded frame is removed so the new one keeps its place in order
+			o.remove(i)
+			o.coalesced++
+			result = pushCoalesced
+		}
+	}
+
+	if len(o.frames) >= o.capacity {
+		i := -1
+		switch o.policy {
+		case config.DropOldest:
+			i = o.indexOfEvent()
+		case config.Coalesce:
+			i = o.indexOfAnyKey()
+		}
+		if i < 0 {
+			return pushOverflow
+		}
+		o.remove(i)
+		o.dropped++
+		result = pushDropped
+	}
+
+	o.frames = append(o.frames, f)
+	o.signal()
+
+	return result
+}
+
+// drain removes and returns the queued frames, and whether the outbox was closed.
+func (o *outbox) drain() ([][]byte, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	messages := make([][]byte, len(o.frames))
+	for i, frame := range o.frames {
+		messages[i] = frame.data
+	}
+	o.frames = nil
+
+	return messages, o.closed
+}
+
+// take removes and returns the queued frames.
+func (o *outbox) take() []frame {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	frames := o.frames
+	o.frames = nil
+
+	return frames
+}
+
+// addCounts adds frames dropped or coalesced elsewhere on behalf of the outbox,
+// such as while they were held back during a replay.
+func (o *outbox) addCounts(dropped int64, coalesced int64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.dropped += dropped
+	o.coalesced += coalesced
+}
+
+// close stops accepting frames. The WritePump writes the queued frames and then
+// closes the connection with the given code and reason, if any.
+func (o *outbox) close(code int, reason string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.closeCode = code
+	o.closeReason = reason
+	o.signal()
+}
+
+// stats returns the queue depth and the number of dropped and coalesced frames.
+func (o *outbox) stats() (int, int64, int64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.frames), o.dropped, o.coalesced
+}
+
+// closeMessage returns the close code and reason set by close.
+func (o *outbox) closeMessage() (int, string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.closeCode, o.closeReason
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) indexOf(key string) int {
+	for i, frame := range o.frames {
+		if frame.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexOfEvent returns the oldest frame that is not a control frame.
+func (o *outbox) indexOfEvent() int {
+	for i, frame := range o.frames {
+		if !frame.control {
+			return i
+		}
+	}
+	return -1
+}
+
+func (o *outbox) indexOfAnyKey() int {
+	for i, frame := range o.frames {
+		if frame.key != "" {
+			return i
+		}
+	}
+	return -1
+}
+
+func (o *outbox) remove(i int) {
+	copy(o.frames[i:], o.frames[i+1:])
+	o.frames[len(o.frames)-1] = frame{}
+	o.frames = o.frames[:len(o.frames)-1]
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"chatService/config"
+	"reflect"
+	"testing"
+)
+
+func TestOutboxPush(t *testing.T) {
+	event := func(data string) frame { return frame{data: []byte(data)} }
+	keyed := func(data string, key string) frame { return frame{data: []byte(data), key: key} }
+	control := func(data string) frame { return frame{data: []byte(data), control: true} }
+
+	tests := []struct {
+		name      string
+		policy    string
+		frames    []frame
+		results   []pushResult
+		queued    []string
+		dropped   int64
+		coalesced int64
+	}{
+		{
+			name:    "disconnect queues until full",
+			policy:  config.Disconnect,
+			frames:  []frame{event("a"), event("b")},
+			results: []pushResult{pushQueued, pushQueued},
+			queued:  []string{"a", "b"},
+		},
+		{
+			name:    "disconnect overflows when full",
+			policy:  config.Disconnect,
+			frames:  []frame{event("a"), event("b"), event("c")},
+			results: []pushResult{pushQueued, pushQueued, pushOverflow},
+			queued:  []string{"a", "b"},
+		},
+		{
+			name:    "disconnect never coalesces",
+			policy:  config.Disconnect,
+			frames:  []frame{keyed("a", "k"), keyed("b", "k")},
+			results: []pushResult{pushQueued, pushQueued},
+			queued:  []string{"a", "b"},
+		},
+		{
+			name:    "drop_oldest drops the oldest frame",
+			policy:  config.DropOldest,
+			frames:  []frame{event("a"), event("b"), event("c")},
+			results: []pushResult{pushQueued, pushQueued, pushDropped},
+			queued:  []string{"b", "c"},
+			dropped: 1,
+		},
+		{
+			name:    "drop_oldest keeps control frames",
+			policy:  config.DropOldest,
+			frames:  []frame{control("ack"), event("b"), event("c")},
+			results: []pushResult{pushQueued, pushQueued, pushDropped},
+			queued:  []string{"ack", "c"},
+			dropped: 1,
+		},
+		{
+			name:    "drop_oldest makes room for control frames",
+			policy:  config.DropOldest,
+			frames:  []frame{event("a"), event("b"), control("ack")},
+			results: []pushResult{pushQueued, pushQueued, pushDropped},
+			queued:  []string{"b", "ack"},
+			dropped: 1,
+		},
+		{
+			name:    "drop_oldest overflows when only control frames are queued",
+			policy:  config.DropOldest,
+			frames:  []frame{control("ack"), control("error"), event("c")},
+			results: []pushResult{pushQueued, pushQueued, pushOverflow},
+			queued:  []string{"ack", "error"},
+		},
+		{
+			name:      "coalesce replaces frames with the same key",
+			policy:    config.Coalesce,
+			frames:    []frame{keyed("typing", "t"), event("message"), keyed("stopped", "t")},
+			results:   []pushResult{pushQueued, pushQueued, pushCoalesced},
+			queued:    []string{"message", "stopped"},
+			coalesced: 1,
+		},
+		{
+			name:    "coalesce drops the oldest keyed frame when full",
+			policy:  config.Coalesce,
+			frames:  []frame{event("a"), keyed("presence", "p"), event("b")},
+			results: []pushResult{pushQueued, pushQueued, pushDropped},
+			queued:  []string{"a", "b"},
+			dropped: 1,
+		},
+		{
+			name:    "coalesce overflows without keyed frames",
+			policy:  config.Coalesce,
+			frames:  []frame{event("a"), control("ack"), event("b")},
+			results: []pushResult{pushQueued, pushQueued, pushOverflow},
+			queued:  []string{"a", "ack"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newOutbox(2, test.policy)
+
+			var results []pushResult
+			for _, f := range test.frames {
+				results = append(results, o.push(f))
+			}
+			if !reflect.DeepEqual(results, test.results) {
+				t.Errorf("results = %v, want %v", results, test.results)
+			}
+
+			messages, closed := o.drain()
+			if closed {
+				t.Errorf("outbox is closed")
+			}
+			var queued []string
+			for _, message := range messages {
+				queued = append(queued, string(message))
+			}
+			if !reflect.DeepEqual(queued, test.queued) {
+				t.Errorf("queued = %v, want %v", queued, test.queued)
+			}
+
+			if _, dropped, coalesced := o.stats(); dropped != test.dropped || coalesced != test.coalesced {
+				t.Errorf("dropped, coalesced = %d, %d, want %d, %d", dropped, coalesced, test.dropped, test.coalesced)
+			}
+		})
+	}
+}
+
+func TestOutboxPushClosed(t *testing.T) {
+	o := newOutbox(2, config.DropOldest)
+	o.close(0, "")
+
+	if result := o.push(frame{data: []byte("a")}); result != pushClosed {
+		t.Errorf("result = %v, want %v", result, pushClosed)
+	}
+}
+
+func TestQueueBoundsBacklog(t *testing.T) {
+	tests := []struct {
+		policy string
+		ok     []bool
+		held   []string
+	}{
+		{policy: config.Disconnect, ok: []bool{true, true, false}, held: []string{"a", "b"}},
+		{policy: config.DropOldest, ok: []bool{true, true, true}, held: []string{"b", "c"}},
+		{policy: config.Coalesce, ok: []bool{true, true, false}, held: []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			h := &Hub{}
+			client := &Client{
+				outbox:    newOutbox(2, test.policy),
+				replaying: true,
+				backlog:   newOutbox(2, test.policy),
+			}
+
+			var ok []bool
+			for _, data := range []string{"a", "b", "c"} {
+				ok = append(ok, h.queue(client, frame{data: []byte(data)}))
+			}
+			if !reflect.DeepEqual(ok, test.ok) {
+				t.Errorf("queue = %v, want %v", ok, test.ok)
+			}
+
+			var held []string
+			for _, f := range client.backlog.take() {
+				held = append(held, string(f.data))
+			}
+			if !reflect.DeepEqual(held, test.held) {
+				t.Errorf("held = %v, want %v", held, test.held)
+			}
+
+			if depth, _, _ := client.outbox.stats(); depth != 0 {
+				t.Errorf("outbox depth = %d, want 0", depth)
+			}
+		})
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		event OutgoingEvent
+		key   string
+	}{
+		{
+			name:  "typing started",
+			event: OutgoingEvent{Type: TypingStarted, ConversationId: "c", UserId: "u"},
+			key:   "typing:c:u",
+		},
+		{
+			name:  "typing stopped shares the key of typing started",
+			event: OutgoingEvent{Type: TypingStopped, ConversationId: "c", UserId: "u"},
+			key:   "typing:c:u",
+		},
+		{
+			name:  "presence",
+			event: OutgoingEvent{Type: PresenceChanged, UserId: "u"},
+			key:   "presence:u",
+		},
+		{
+			name:  "read receipt",
+			event: OutgoingEvent{Type: ReadMessages, ConversationId: "c", ReadReceipt: &ReadReceipt{UserId: "u"}},
+			key:   "read:c:u",
+		},
+		{
+			name:  "read without receipt",
+			event: OutgoingEvent{Type: ReadMessages, ConversationId: "c"},
+			key:   "",
+		},
+		{
+			name:  "activity",
+			event: OutgoingEvent{Type: Activity, ConversationId: "c"},
+			key:   "activity:c",
+		},
+		{
+			name:  "messages are never coalesced",
+			event: OutgoingEvent{Type: AddMessage, ConversationId: "c", Message: &Message{Id: "m"}},
+			key:   "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if key := coalesceKey(test.event); key != test.key {
+				t.Errorf("coalesceKey = %q, want %q", key, test.key)
+			}
+		})
+	}
+}
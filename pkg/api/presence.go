@@ -0,0 +1,232 @@
+package api
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	OnlineStatus  = "ONLINE"
+	AwayStatus    = "AWAY"
+	OfflineStatus = "OFFLINE"
+
+	// Time without activity from the peer after which a connection is considered idle.
+	idleTimeout = 5 * time.Minute
+
+	// Interval at which an instance extends the statuses it stored, and the time
+	// after which the statuses of an instance that stopped refreshing expire.
+	presenceRefreshPeriod = 30 * time.Second
+	presenceExpiry        = 3 * presenceRefreshPeriod
+)
+
+// PresenceTracker derives the status of users from their connections to the Hub.
+//
+// A user is online while any of their connections is active, away while all of
+// their connections are idle and offline once the last connection unregisters.
+// Each instance stores the status of the connections it holds, and the user's
+// status combines those of all instances. Changes of the combined status are
+// persisted and pushed to the users that share a conversation with them.
+type PresenceTracker struct {
+	hub *Hub
+
+	userService UserService
+
+	chatService ChatService
+
+	// Connections of each user and whether they are active
+	sessions map[string]map[*Client]bool
+
+	// Last published status of the connections of each user on this instance
+	statuses map[string]string
+
+	// Status changes waiting to be published, keyed by user id
+	pending map[string]UserPresence
+
+	// Signals the publisher that there are pending changes
+	notify chan struct{}
+
+	// Closed when Run returned after the Hub stopped
+	stopped chan struct{}
+
+	mutex sync.Mutex
+}
+
+func NewPresenceTracker(userService UserService, chatService ChatService) *PresenceTracker {
+	return &PresenceTracker{
+		userService: userService,
+		chatService: chatService,
+		sessions:    make(map[string]map[*Client]bool),
+		statuses:    make(map[string]string),
+		pending:     make(map[string]UserPresence),
+		notify:      make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
+	}
+}
+
+// Run publishes pending status changes and keeps the statuses stored by this
+// instance from expiring. Changes are published one at a time so that a user's
+// consecutive changes are never reordered. Run returns once the Hub stopped, after
+// publishing the statuses of the connections closed on shutdown.
+func (p *PresenceTracker) Run() {
+	defer close(p.stopped)
+
+	ticker := time.NewTicker(presenceRefreshPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.notify:
+			p.publishPending()
+		case <-ticker.C:
+			p.refresh()
+		case <-p.hub.done:
+			p.publishPending()
+			return
+		}
+	}
+}
+
+// publishPending publishes the pending status changes.
+func (p *PresenceTracker) publishPending() {
+	p.mutex.Lock()
+	pending := p.pending
+	p.pending = make(map[string]UserPresence)
+	p.mutex.Unlock()
+
+	for _, presence := range pending {
+		p.publish(presence)
+	}
+}
+
+// connect is called by the Hub when a Client registers.
+func (p *PresenceTracker) connect(c *Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.sessions[c.id] == nil {
+		p.sessions[c.id] = make(map[*Client]bool)
+	}
+	p.sessions[c.id][c] = true
+	p.update(c.id, true)
+}
+
+// disconnect is called by the Hub when a Client unregisters.
+func (p *PresenceTracker) disconnect(c *Client) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.sessions[c.id], c)
+	if len(p.sessions[c.id]) == 0 {
+		delete(p.sessions, c.id)
+	}
+	p.update(c.id, true)
+}
+
+// active marks a connection as active after the peer sent a message.
+func (p *PresenceTracker) active(c *Client) {
+	p.setActive(c, true)
+}
+
+// idle marks a connection as idle once the peer has been quiet for idleTimeout.
+func (p *PresenceTracker) idle(c *Client) {
+	p.setActive(c, false)
+}
+
+func (p *PresenceTracker) setActive(c *Client, active bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sessions, ok := p.sessions[c.id]
+	if !ok {
+		return
+	}
+	if _, ok := sessions[c]; !ok || sessions[c] == active {
+		return
+	}
+	sessions[c] = active
+	p.update(c.id, false)
+}
+
+// update recomputes the status of a user and queues it when it changed, or always
+// when a connection was opened or closed so the last activity of the user is stored.
+// Callers must hold the mutex.
+func (p *PresenceTracker) update(userId string, connectionChanged bool) {
+	status := OfflineStatus
+	for _, active := range p.sessions[userId] {
+		if active {
+			status = OnlineStatus
+			break
+		}
+		status = AwayStatus
+	}
+
+	previousStatus, ok := p.statuses[userId]
+	if !ok {
+		previousStatus = OfflineStatus
+	}
+	if status == previousStatus && !connectionChanged {
+		return
+	}
+
+	if status == OfflineStatus {
+		delete(p.statuses, userId)
+	} else {
+		p.statuses[userId] = status
+	}
+
+	p.pending[userId] = UserPresence{
+		UserId:       userId,
+		Status:       status,
+		LastActivity: time.Now(),
+	}
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// publish stores a status change of this instance and sends the user's combined
+// status to their contacts when it changed.
+func (p *PresenceTracker) publish(presence UserPresence) {
+	presence, changed, err := p.userService.UpdateInstancePresence(p.hub.id, presence, time.Now().Add(presenceExpiry))
+	if err != nil {
+		log.Printf("Unable to update presence of user %s: %v", presence.UserId, err)
+		return
+	}
+	if changed {
+		p.send(presence)
+	}
+}
+
+// refresh extends the statuses stored by this instance and sends the statuses of
+// users that went offline because the instance holding their connections stopped.
+func (p *PresenceTracker) refresh() {
+	presences, err := p.userService.RefreshInstancePresence(p.hub.id, time.Now().Add(presenceExpiry))
+	if err != nil {
+		log.Printf("Unable to refresh presence: %v", err)
+	}
+
+	for _, presence := range presences {
+		p.send(presence)
+	}
+}
+
+// send pushes a status change to the user's contacts.
+func (p *PresenceTracker) send(presence UserPresence) {
+	contactIds, err := p.chatService.GetContactIds(presence.UserId)
+	if err != nil {
+		log.Printf("Unable to get contacts of user %s: %v", presence.UserId, err)
+		return
+	}
+	if len(contactIds) == 0 {
+		return
+	}
+
+	p.hub.Send(OutgoingEvent{
+		Type:         PresenceChanged,
+		Participants: contactIds,
+		UserId:       presence.UserId,
+		Presence:     &presence,
+	})
+}
@@ -0,0 +1,41 @@
+package api
+
+import "testing"
+
+func TestPresenceTrackerUpdate(t *testing.T) {
+	p := NewPresenceTracker(nil, nil)
+	first := &Client{id: "me"}
+	second := &Client{id: "me"}
+
+	pending := func() (UserPresence, bool) {
+		presence, ok := p.pending["me"]
+		p.pending = make(map[string]UserPresence)
+		return presence, ok
+	}
+
+	steps := []struct {
+		name   string
+		change func()
+		queued bool
+		status string
+	}{
+		{name: "first connection", change: func() { p.connect(first) }, queued: true, status: OnlineStatus},
+		{name: "second connection", change: func() { p.connect(second) }, queued: true, status: OnlineStatus},
+		{name: "one connection idle", change: func() { p.idle(second) }, queued: false},
+		{name: "all connections idle", change: func() { p.idle(first) }, queued: true, status: AwayStatus},
+		{name: "one connection closed", change: func() { p.disconnect(second) }, queued: true, status: AwayStatus},
+		{name: "last connection closed", change: func() { p.disconnect(first) }, queued: true, status: OfflineStatus},
+	}
+
+	for _, step := range steps {
+		step.change()
+
+		presence, queued := pending()
+		if queued != step.queued {
+			t.Errorf("%s: queued = %v, want %v", step.name, queued, step.queued)
+		}
+		if queued && presence.Status != step.status {
+			t.Errorf("%s: status = %s, want %s", step.name, presence.Status, step.status)
+		}
+	}
+}
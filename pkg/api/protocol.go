@@ -0,0 +1,139 @@
+package api
+
+import (
+	"errors"
+	"log"
+)
+
+// Version of the websocket protocol spoken by the server. Clients negotiate it
+// together with a codec through the Sec-WebSocket-Protocol header.
+const (
+	ProtocolVersion = 1
+	Subprotocol     = "chat.v1"
+)
+
+// Types of frames exchanged over the websocket.
+const (
+	Authenticate          = "auth"
+	TokenExpiring         = "auth.expiring"
+	Sync                  = "sync"
+	AddMessage            = "message.add"
+	EditMessage           = "message.edit"
+	RemoveMessage         = "message.remove"
+	AddParticipant        = "participant.add"
+	RemoveParticipant     = "participant.remove"
+	TypingStarted         = "typing.start"
+	TypingStopped         = "typing.stop"
+	ReadMessages          = "conversation.read"
+	Subscribe             = "conversation.subscribe"
+	Unsubscribe           = "conversation.unsubscribe"
+	Activity              = "conversation.activity"
+	ConversationAdded     = "conversation.added"
+	PresenceChanged       = "presence.change"
+	AnnouncementPublished = "announcement.publish"
+	AnnouncementWithdrawn = "announcement.withdraw"
+	AddReaction           = "reaction.add"
+	RemoveReaction        = "reaction.remove"
+	GoingAway             = "server.going_away"
+	Ack                   = "ack"
+	Error                 = "error"
+)
+
+// Codes sent in error frames.
+const (
+	ErrorCodeBadRequest         = "bad_request"
+	ErrorCodeMessageTooLarge    = "message_too_large"
+	ErrorCodeUnsupportedVersion = "unsupported_version"
+	ErrorCodeUnsupportedType    = "unsupported_type"
+	ErrorCodeUnauthorized       = "unauthorized"
+	ErrorCodeForbidden          = "forbidden"
+	ErrorCodeNotFound           = "not_found"
+	ErrorCodeInternal           = "internal"
+)
+
+// Envelope wraps every frame sent over the websocket. Requests carry an id chosen
+// by the client which is echoed in the ack or error frame answering them.
+type Envelope struct {
+	Type    string      `json:"type"`
+	Id      string      `json:"id,omitempty"`
+	Version int         `json:"version"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// incomingEnvelope is an Envelope received from the peer. The payload of every
+// request is an IncomingEvent.
+type incomingEnvelope struct {
+	Type    string        `json:"type"`
+	Id      string        `json:"id,omitempty"`
+	Version int           `json:"version"`
+	Payload IncomingEvent `json:"payload"`
+}
+
+// SyncResult is the payload of the ack answering a sync request.
+type SyncResult struct {
+	Events []Envelope `json:"events"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// encodeFrame wraps a payload in an envelope of the current protocol version.
+func encodeFrame(codec Codec, frameType string, id string, payload interface{}) ([]byte, error) {
+	return codec.Marshal(Envelope{
+		Type:    frameType,
+		Id:      id,
+		Version: ProtocolVersion,
+		Payload: payload,
+	})
+}
+
+// eventEnvelope wraps an outgoing event in an envelope named after its type.
+func eventEnvelope(outgoingEvent OutgoingEvent) Envelope {
+	return Envelope{
+		Type:    outgoingEvent.Type,
+		Version: ProtocolVersion,
+		Payload: outgoingEvent,
+	}
+}
+
+// encodeEvent encodes an outgoing event with the codec of the receiving Client.
+func encodeEvent(codec Codec, outgoingEvent OutgoingEvent) ([]byte, error) {
+	return codec.Marshal(eventEnvelope(outgoingEvent))
+}
+
+// errorCode maps errors returned by the chat service to error frame codes.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		return ErrorCodeNotFound
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrNotMessageSender), errors.Is(err, ErrNotParticipant),
+		errors.Is(err, ErrOneToOneConversation), errors.Is(err, ErrNotConversationOwner):
+		return ErrorCodeForbidden
+	case errors.Is(err, ErrInvalidReaction), errors.Is(err, ErrInvalidMessage), errors.Is(err, ErrInvalidClientKey):
+		return ErrorCodeBadRequest
+	default:
+		return ErrorCodeInternal
+	}
+}
+
+// sendAck answers a request that succeeded. The payload is the resulting event.
+func (c *Client) sendAck(requestId string, payload interface{}) {
+	frame, err := encodeFrame(c.codec, Ack, requestId, payload)
+	if err != nil {
+		log.Printf("Could not encode ack frame: %v", err)
+		return
+	}
+	c.Hub.sendControl(c, frame)
+}
+
+// sendError answers a request that failed.
+func (c *Client) sendError(requestId string, code string, message string) {
+	frame, err := encodeFrame(c.codec, Error, requestId, ErrorPayload{Code: code, Message: message})
+	if err != nil {
+		log.Printf("Could not encode error frame: %v", err)
+		return
+	}
+	c.Hub.sendControl(c, frame)
+}
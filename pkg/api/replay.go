@@ -0,0 +1,93 @@
+package api
+
+import (
+	"log"
+)
+
+// replay carries the events a Client missed while it was disconnected.
+type replay struct {
+	client    *Client
+	requestId string
+	events    []OutgoingEvent
+
+	// Whether events are queued as individual frames instead of a single ack,
+	// for receive-only clients that cannot send a sync request
+	separate bool
+}
+
+// replay fetches the events persisted after the client's cursors and hands them to
+// the Hub, which delivers them ahead of the live events held back in the meantime.
+func (c *Client) replay(requestId string, cursors map[string]int64, separate bool) {
+	outgoingEvents, err := c.chatService.GetMissedEvents(c.id, cursors)
+	if err != nil {
+		// Live delivery still resumes, the client reloads conversations through the REST API
+		log.Printf("Unable to get missed events of user %s: %v", c.id, err)
+	}
+
+	select {
+	case c.Hub.resume <- replay{client: c, requestId: requestId, events: outgoingEvents, separate: separate}:
+	case <-c.Hub.done:
+	}
+}
+
+// resumeClient answers the sync request with the replayed events, followed by the
+// live events that were held back while the replay was prepared.
+func (h *Hub) resumeClient(replay replay) {
+	client := replay.client
+	if !h.isRegistered(client) {
+		return
+	}
+	client.replaying = false
+
+	var frames []frame
+	if replay.separate {
+		for _, outgoingEvent := range replay.events {
+			message, err := encodeEvent(client.codec, outgoingEvent)
+			if err != nil {
+				log.Printf("Could not process replayed message: %v", err)
+				continue
+			}
+			frames = append(frames, frame{data: message})
+		}
+	} else {
+		// Replayed events are sent in a single ack so a large replay does not
+		// overflow the send queue
+		result := SyncResult{Events: make([]Envelope, len(replay.events))}
+		for i, outgoingEvent := range replay.events {
+			result.Events[i] = eventEnvelope(outgoingEvent)
+		}
+
+		ack, err := encodeFrame(client.codec, Ack, replay.requestId, result)
+		if err != nil {
+			log.Printf("Could not process replayed messages: %v", err)
+		} else {
+			frames = append(frames, frame{data: ack, control: true})
+		}
+	}
+
+	// Live events held back meanwhile are skipped when the replay already holds them
+	replayed := make(map[string]int64)
+	for _, outgoingEvent := range replay.events {
+		if outgoingEvent.Sequence > replayed[outgoingEvent.ConversationId] {
+			replayed[outgoingEvent.ConversationId] = outgoingEvent.Sequence
+		}
+	}
+	if client.backlog != nil {
+		for _, frame := range client.backlog.take() {
+			if frame.sequence > 0 && frame.sequence <= replayed[frame.conversationId] {
+				continue
+			}
+			frames = append(frames, frame)
+		}
+		_, dropped, coalesced := client.backlog.stats()
+		client.outbox.addCounts(dropped, coalesced)
+		client.backlog = nil
+	}
+
+	for _, frame := range frames {
+		if !h.enqueue(client, frame) {
+			h.dropSlowClients([]*Client{client})
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"firebase.google.com/go/v4/auth"
+	"github.com/gorilla/websocket"
+	"log"
+	"time"
+)
+
+const (
+	// Time before the ID token expires at which the peer is asked to re-authenticate.
+	tokenExpiryWarning = 5 * time.Minute
+
+	// Period at which the account is checked for being disabled or having its tokens revoked.
+	accountCheckPeriod = 5 * time.Minute
+)
+
+type TokenExpiry struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// setToken records the expiry of the ID token the Client is authenticated with.
+func (c *Client) setToken(token *auth.Token) {
+	c.sessionMutex.Lock()
+	c.tokenExpiresAt = time.Unix(token.Expires, 0)
+	c.tokenIssuedAt = time.Unix(token.IssuedAt, 0)
+	c.sessionMutex.Unlock()
+}
+
+func (c *Client) tokenTimes() (time.Time, time.Time) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	return c.tokenExpiresAt, c.tokenIssuedAt
+}
+
+// reauthenticate replaces the ID token of the Client with a fresh one sent by the peer.
+func (c *Client) reauthenticate(requestId string, idToken string) {
+	token, err := c.auth.VerifyIDTokenAndCheckRevoked(context.Background(), idToken)
+	if err != nil {
+		c.sendError(requestId, ErrorCodeUnauthorized, "Token not valid.")
+		return
+	} else if token.UID != c.id {
+		c.sendError(requestId, ErrorCodeUnauthorized, "Token does not match Client uid")
+		return
+	}
+
+	c.setToken(token)
+
+	// Wake up the session watcher so it schedules the new expiry
+	select {
+	case c.reauthenticated <- struct{}{}:
+	default:
+	}
+
+	c.sendAck(requestId, TokenExpiry{ExpiresAt: time.Unix(token.Expires, 0)})
+}
+
+// watchSession warns the peer before its ID token expires and closes the connection
+// once it has expired or the account was disabled or had its tokens revoked.
+//
+// A goroutine running watchSession is started for each connection and stops when
+// done is closed.
+func (c *Client) watchSession(done <-chan struct{}) {
+	accountTicker := time.NewTicker(accountCheckPeriod)
+	defer accountTicker.Stop()
+
+	// Expiry the peer was last warned about
+	var warnedExpiry time.Time
+
+	for {
+		expiresAt, _ := c.tokenTimes()
+
+		deadline := expiresAt.Add(-tokenExpiryWarning)
+		if warnedExpiry.Equal(expiresAt) {
+			deadline = expiresAt
+		}
+		timer := time.NewTimer(time.Until(deadline))
+
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-c.reauthenticated:
+			timer.Stop()
+		case <-accountTicker.C:
+			timer.Stop()
+			if reason := c.checkAccount(); reason != "" {
+				c.closeWith(websocket.ClosePolicyViolation, reason)
+				return
+			}
+		case <-timer.C:
+			if time.Now().Before(expiresAt) {
+				warnedExpiry = expiresAt
+				frame, err := encodeFrame(c.codec, TokenExpiring, "", TokenExpiry{ExpiresAt: expiresAt})
+				if err != nil {
+					log.Printf("Could not encode token expiry frame: %v", err)
+					continue
+				}
+				c.Hub.sendControl(c, frame)
+				continue
+			}
+
+			c.closeWith(websocket.ClosePolicyViolation, "Token expired")
+			return
+		}
+	}
+}
+
+// checkAccount returns why the session has to end, or an empty string when the
+// account is still allowed to use the connection.
+func (c *Client) checkAccount() string {
+	user, err := c.auth.GetUser(context.Background(), c.id)
+	if auth.IsUserNotFound(err) {
+		return "Account deleted"
+	} else if err != nil {
+		// Keep the session open when the check itself fails
+		log.Printf("Unable to check account of user %s: %v", c.id, err)
+		return ""
+	}
+
+	if user.Disabled {
+		return "Account disabled"
+	}
+
+	_, issuedAt := c.tokenTimes()
+	if issuedAt.Unix()*1000 < user.TokensValidAfterMillis {
+		return "Token revoked"
+	}
+
+	return ""
+}
+
+// closeWith closes the connection with a close code and reason. Closing the
+// connection stops ReadPump, which unregisters the Client from the Hub.
+func (c *Client) closeWith(code int, reason string) {
+	// Receive-only clients end their stream once the Hub closes their outbox
+	if c.conn == nil {
+		c.Hub.inspect(func() {
+			c.Hub.removeClient(c, code, reason)
+		})
+		return
+	}
+
+	message := websocket.FormatCloseMessage(code, reason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(c.Hub.config.WriteWait)); err != nil {
+		log.Printf("Unable to send close message: %v", err)
+	}
+	_ = c.conn.Close()
+}
@@ -0,0 +1,302 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"firebase.google.com/go/v4/auth"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Time before the position of a resumed stream from which events are written again.
+// It covers events delivered out of commit order and clock differences between
+// instances and the database.
+const resumeOverlap = 10 * time.Second
+
+// EventStreamClient is a receive-only Client served as server-sent events, for
+// networks that break websockets. Requests are sent through the REST API.
+type EventStreamClient struct {
+	*Client
+
+	// Last sequence written for each conversation, so events written during the
+	// catch-up are not written again
+	cursors map[string]int64
+
+	// Position the stream resumes from, zero for new streams
+	resumeFrom time.Time
+}
+
+func NewEventStreamClient(hub *Hub, token *auth.Token, authClient *auth.Client, chatService ChatService, remoteAddr string, lastEventId string) *EventStreamClient {
+	client := &EventStreamClient{
+		Client:     newClient(hub, token, authClient, chatService, remoteAddr),
+		cursors:    make(map[string]int64),
+		resumeFrom: parseEventId(lastEventId),
+	}
+	client.activity = make(chan struct{}, 1)
+
+	return client
+}
+
+// streamedFrame holds the parts of an encoded frame needed to track cursors.
+type streamedFrame struct {
+	Type    string `json:"type"`
+	Payload struct {
+		ConversationId string `json:"conversationId"`
+		Sequence       int64  `json:"sequence"`
+	} `json:"payload"`
+}
+
+// Serve writes the missed events since the Last-Event-ID and then the live
+// events of the Client until the request ends or the Hub closes the Client. The
+// Client must be registered with the Hub.
+func (c *EventStreamClient) Serve(ctx context.Context, w http.ResponseWriter, flusher http.Flusher) {
+	done := make(chan struct{})
+	go c.watchSession(done)
+
+	// The stream is idle unless the user makes requests through the REST API
+	idleTimer := time.AfterFunc(idleTimeout, func() {
+		c.Hub.presence.idle(c.Client)
+	})
+
+	defer func() {
+		close(done)
+		idleTimer.Stop()
+		select {
+		case c.Hub.unregister <- c.Client:
+		case <-c.Hub.done:
+		}
+		c.Hub.writers.Done()
+	}()
+
+	config := c.Hub.config
+	ticker := time.NewTicker(config.PingPeriod)
+	defer ticker.Stop()
+
+	// Live events are held back until the missed events have been written
+	if !c.resumeFrom.IsZero() {
+		if !c.catchUp(w) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.outbox.ready:
+			messages, closed := c.outbox.drain()
+			for _, message := range messages {
+				if err := c.writeEvent(w, message, time.Now()); err != nil {
+					return
+				}
+			}
+
+			if closed {
+				// The hub closed the outbox.
+				code, reason := c.outbox.closeMessage()
+				if code != 0 {
+					_, _ = w.Write([]byte("event: close\ndata: " + strconv.Itoa(code) + " " + reason + "\n\n"))
+				}
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+		case <-c.activity:
+			c.Hub.presence.active(c.Client)
+			idleTimer.Reset(idleTimeout)
+		case <-ticker.C:
+			// Comments keep proxies from closing an idle stream
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// catchUp writes the events missed since the Last-Event-ID ahead of the live
+// events held back meanwhile. It reports false when the stream broke.
+func (c *EventStreamClient) catchUp(w http.ResponseWriter) bool {
+	select {
+	case c.Hub.hold <- c.Client:
+	case <-c.Hub.done:
+		return false
+	}
+
+	// Events committed later are held back and written live
+	fetchedAt := time.Now()
+	outgoingEvents, err := c.chatService.GetEventsSince(c.id, c.resumeFrom.Add(-resumeOverlap))
+	if err != nil {
+		log.Printf("Unable to get missed events of user %s: %v", c.id, err)
+	}
+
+	ok := true
+	for _, outgoingEvent := range outgoingEvents {
+		message, err := encodeEvent(c.codec, outgoingEvent)
+		if err != nil {
+			log.Printf("Could not process replayed message: %v", err)
+			continue
+		}
+		if err := c.writeEvent(w, message, fetchedAt); err != nil {
+			ok = false
+			break
+		}
+	}
+
+	select {
+	case c.Hub.resume <- replay{client: c.Client, separate: true}:
+	case <-c.Hub.done:
+		return false
+	}
+
+	return ok
+}
+
+// writeEvent writes a frame as a server-sent event. Persisted events advance the
+// cursors and are sent with the position of the stream as event id, and events
+// the stream already wrote during the catch-up are skipped.
+func (c *EventStreamClient) writeEvent(w http.ResponseWriter, message []byte, position time.Time) error {
+	var buffer bytes.Buffer
+
+	var streamed streamedFrame
+	if err := json.Unmarshal(message, &streamed); err == nil {
+		payload := streamed.Payload
+		if payload.Sequence > 0 {
+			if payload.Sequence <= c.cursors[payload.ConversationId] {
+				return nil
+			}
+			c.cursors[payload.ConversationId] = payload.Sequence
+			buffer.WriteString("id: " + formatEventId(position) + "\n")
+		}
+		buffer.WriteString("event: " + streamed.Type + "\n")
+	}
+
+	buffer.WriteString("data: ")
+	buffer.Write(message)
+	buffer.WriteString("\n\n")
+
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// formatEventId encodes a position of the stream as milliseconds since the epoch.
+func formatEventId(position time.Time) string {
+	return strconv.FormatInt(position.UnixMilli(), 10)
+}
+
+// parseEventId decodes the position of an event id. Malformed ids, including the
+// cursor lists sent by earlier versions, start a new stream.
+func parseEventId(eventId string) time.Time {
+	milliseconds, err := strconv.ParseInt(eventId, 10, 64)
+	if err != nil || milliseconds <= 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(milliseconds)
+}
+
+// Touch marks the receive-only connections of a user as active after the user
+// made a request through the REST API. Connections on other instances are
+// reached through the backplane, at most once per ping period for each user.
+func (h *Hub) Touch(userId string) {
+	if h.streams.touch(userId, h.config.PingPeriod) {
+		h.publishEvent(backplaneEvent{Type: userActivityType, ActiveUserId: userId})
+	}
+}
+
+// streamActivity tracks the receive-only connections of the users, so requests
+// mark them active without waiting for the Hub goroutine.
+type streamActivity struct {
+	// Receive-only clients of each user on this Hub
+	clients map[string][]*Client
+
+	// When the activity of each user was last published to the backplane
+	published map[string]time.Time
+
+	// When publish times older than the interval were last removed
+	swept time.Time
+
+	mutex sync.Mutex
+}
+
+func (s *streamActivity) add(client *Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.clients == nil {
+		s.clients = make(map[string][]*Client)
+	}
+	s.clients[client.id] = append(s.clients[client.id], client)
+}
+
+func (s *streamActivity) remove(client *Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clients := s.clients[client.id]
+	for i, registered := range clients {
+		if registered == client {
+			clients[i] = clients[len(clients)-1]
+			clients[len(clients)-1] = nil
+			clients = clients[:len(clients)-1]
+			break
+		}
+	}
+
+	if len(clients) == 0 {
+		delete(s.clients, client.id)
+	} else {
+		s.clients[client.id] = clients
+	}
+}
+
+// signal signals activity to the receive-only connections of a user.
+func (s *streamActivity) signal(userId string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.signalLocked(userId)
+}
+
+// touch signals activity to the receive-only connections of a user and reports
+// whether the activity is due to be published, once per interval.
+func (s *streamActivity) touch(userId string, interval time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.signalLocked(userId)
+
+	now := time.Now()
+	if s.published == nil {
+		s.published = make(map[string]time.Time)
+	}
+	if now.Sub(s.swept) >= interval {
+		for id, published := range s.published {
+			if now.Sub(published) >= interval {
+				delete(s.published, id)
+			}
+		}
+		s.swept = now
+	}
+
+	if published, ok := s.published[userId]; ok && now.Sub(published) < interval {
+		return false
+	}
+	s.published[userId] = now
+
+	return true
+}
+
+func (s *streamActivity) signalLocked(userId string) {
+	for _, client := range s.clients[userId] {
+		select {
+		case client.activity <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamActivityTouch(t *testing.T) {
+	var streams streamActivity
+	stream := &Client{id: "me", activity: make(chan struct{}, 1)}
+	streams.add(stream)
+
+	signaled := func() bool {
+		select {
+		case <-stream.activity:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if !streams.touch("me", time.Minute) {
+		t.Errorf("first touch is not published")
+	}
+	if !signaled() {
+		t.Errorf("stream is not signaled")
+	}
+
+	// Activity within the interval only reaches the local streams
+	if streams.touch("me", time.Minute) {
+		t.Errorf("second touch is published")
+	}
+	if !signaled() {
+		t.Errorf("stream is not signaled on the second touch")
+	}
+
+	if !streams.touch("friend", time.Minute) {
+		t.Errorf("touch of another user is not published")
+	}
+	if signaled() {
+		t.Errorf("stream is signaled by another user")
+	}
+
+	streams.remove(stream)
+	streams.signal("me")
+	if signaled() {
+		t.Errorf("removed stream is signaled")
+	}
+}
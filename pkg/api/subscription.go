@@ -0,0 +1,205 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"strconv"
+)
+
+// Maximum number of conversations a Client can subscribe to with one request.
+const maxSubscriptionsPerRequest = 50
+
+// delivery describes how an event reaches a Client.
+type delivery int
+
+const (
+	deliverNothing delivery = iota
+	deliverSummary
+	deliverEvent
+)
+
+// subscription changes the conversations a Client focuses on.
+type subscription struct {
+	client *Client
+
+	// Participants of the conversations to subscribe to, keyed by conversation id
+	conversations map[string][]string
+
+	// Conversations to unsubscribe from
+	removed []string
+
+	// Whether all subscriptions are dropped, restoring delivery of every event
+	reset bool
+}
+
+// Subscriptions is the payload of the ack answering a subscription request.
+type Subscriptions struct {
+	ConversationIds []string `json:"conversationIds"`
+}
+
+// subscribe focuses the Client on the requested conversations. Only participants
+// can subscribe to a conversation.
+func (c *Client) subscribe(requestId string, conversationIds []string) {
+	if len(conversationIds) == 0 || len(conversationIds) > maxSubscriptionsPerRequest {
+		c.sendError(requestId, ErrorCodeBadRequest, "Between 1 and "+strconv.Itoa(maxSubscriptionsPerRequest)+" conversation ids are required")
+		return
+	}
+
+	conversations := make(map[string][]string, len(conversationIds))
+	for _, conversationId := range conversationIds {
+		participants, err := c.chatService.GetParticipants(conversationId)
+		if err != nil && !errors.Is(err, ErrConversationNotFound) {
+			log.Printf("Unable to get participants of conversation %s: %v", conversationId, err)
+			c.sendError(requestId, ErrorCodeInternal, "Unable to process request")
+			return
+		}
+
+		if !contains(participants, c.id) {
+			c.sendError(requestId, ErrorCodeForbidden, ErrNotParticipant.Error()+": "+conversationId)
+			return
+		}
+		conversations[conversationId] = participants
+	}
+
+	select {
+	case c.Hub.subscribe <- subscription{client: c, conversations: conversations}:
+	case <-c.Hub.done:
+		return
+	}
+	c.sendAck(requestId, Subscriptions{ConversationIds: conversationIds})
+}
+
+// unsubscribe stops focusing the Client on the given conversations. Without
+// conversation ids every subscription is dropped and all events are delivered again.
+func (c *Client) unsubscribe(requestId string, conversationIds []string) {
+	select {
+	case c.Hub.subscribe <- subscription{client: c, removed: conversationIds, reset: len(conversationIds) == 0}:
+	case <-c.Hub.done:
+		return
+	}
+	c.sendAck(requestId, Subscriptions{ConversationIds: conversationIds})
+}
+
+// updateSubscriptions applies a subscription change of a Client.
+func (h *Hub) updateSubscriptions(subscription subscription) {
+	client := subscription.client
+
+	if subscription.reset {
+		client.subscriptions = nil
+		return
+	}
+
+	if client.subscriptions == nil && len(subscription.conversations) != 0 {
+		client.subscriptions = make(map[string][]string)
+	}
+	for conversationId, participants := range subscription.conversations {
+		client.subscriptions[conversationId] = participants
+	}
+	for _, conversationId := range subscription.removed {
+		delete(client.subscriptions, conversationId)
+	}
+
+	// Without subscriptions left every event is delivered again
+	if len(client.subscriptions) == 0 {
+		client.subscriptions = nil
+	}
+}
+
+// refreshSubscriptions updates the participants of subscriptions to a conversation
+// whose participants changed, so presence follows the current participants. Removed
+// users are unsubscribed from the conversation.
+func (h *Hub) refreshSubscriptions(outgoingEvent OutgoingEvent) {
+	if outgoingEvent.Type != AddParticipant && outgoingEvent.Type != RemoveParticipant {
+		return
+	}
+
+	// Participants of the event are those before the change
+	var participants []string
+	for _, id := range outgoingEvent.Participants {
+		if !contains(outgoingEvent.RemovedParticipants, id) {
+			participants = append(participants, id)
+		}
+	}
+	for _, id := range outgoingEvent.AddedParticipants {
+		if !contains(participants, id) {
+			participants = append(participants, id)
+		}
+	}
+
+	for _, uid := range outgoingEvent.Participants {
+		for _, client := range h.clients[uid] {
+			if _, ok := client.subscriptions[outgoingEvent.ConversationId]; !ok {
+				continue
+			}
+
+			if contains(outgoingEvent.RemovedParticipants, uid) {
+				delete(client.subscriptions, outgoingEvent.ConversationId)
+				if len(client.subscriptions) == 0 {
+					client.subscriptions = nil
+				}
+			} else {
+				client.subscriptions[outgoingEvent.ConversationId] = participants
+			}
+		}
+	}
+}
+
+// deliveryFor decides how an event reaches a Client. Clients without subscriptions
+// receive every event. Otherwise high-volume events are only delivered for
+// subscribed conversations, and messages of other conversations are summarized.
+func deliveryFor(client *Client, outgoingEvent OutgoingEvent) delivery {
+	if client.subscriptions == nil {
+		return deliverEvent
+	}
+
+	switch outgoingEvent.Type {
+	case PresenceChanged:
+		// Presence of users sharing a subscribed conversation
+		for _, participants := range client.subscriptions {
+			if contains(participants, outgoingEvent.UserId) {
+				return deliverEvent
+			}
+		}
+		return deliverNothing
+	case AddParticipant, RemoveParticipant, ConversationAdded:
+		// Membership changes keep the conversation list accurate
+		return deliverEvent
+	}
+
+	if _, ok := client.subscriptions[outgoingEvent.ConversationId]; ok {
+		return deliverEvent
+	}
+
+	switch outgoingEvent.Type {
+	case AddMessage, EditMessage, RemoveMessage:
+		return deliverSummary
+	default:
+		return deliverNothing
+	}
+}
+
+// summarize reduces a message event to the activity shown in a conversation list.
+func summarize(outgoingEvent OutgoingEvent) OutgoingEvent {
+	activity := &ConversationActivity{Type: outgoingEvent.Type}
+	if message := outgoingEvent.Message; message != nil {
+		activity.MessageId = message.Id
+		activity.ParentMessageId = message.ParentMessageId
+		activity.SenderId = message.SenderId
+		activity.Sequence = message.Sequence
+	}
+
+	return OutgoingEvent{
+		ConversationId: outgoingEvent.ConversationId,
+		Type:           Activity,
+		Activity:       activity,
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeliveryFor(t *testing.T) {
+	subscribed := map[string][]string{"focused": {"me", "friend"}}
+
+	tests := []struct {
+		name          string
+		subscriptions map[string][]string
+		event         OutgoingEvent
+		delivery      delivery
+	}{
+		{
+			name:     "every event without subscriptions",
+			event:    OutgoingEvent{Type: TypingStarted, ConversationId: "other"},
+			delivery: deliverEvent,
+		},
+		{
+			name:          "messages of subscribed conversations",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: AddMessage, ConversationId: "focused"},
+			delivery:      deliverEvent,
+		},
+		{
+			name:          "typing in subscribed conversations",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: TypingStarted, ConversationId: "focused"},
+			delivery:      deliverEvent,
+		},
+		{
+			name:          "messages of other conversations are summarized",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: AddMessage, ConversationId: "other"},
+			delivery:      deliverSummary,
+		},
+		{
+			name:          "edits of other conversations are summarized",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: EditMessage, ConversationId: "other"},
+			delivery:      deliverSummary,
+		},
+		{
+			name:          "removals of other conversations are summarized",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: RemoveMessage, ConversationId: "other"},
+			delivery:      deliverSummary,
+		},
+		{
+			name:          "typing in other conversations",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: TypingStarted, ConversationId: "other"},
+			delivery:      deliverNothing,
+		},
+		{
+			name:          "reactions in other conversations",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: AddReaction, ConversationId: "other"},
+			delivery:      deliverNothing,
+		},
+		{
+			name:          "read receipts in other conversations",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: ReadMessages, ConversationId: "other"},
+			delivery:      deliverNothing,
+		},
+		{
+			name:          "presence of users sharing a subscribed conversation",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: PresenceChanged, UserId: "friend"},
+			delivery:      deliverEvent,
+		},
+		{
+			name:          "presence of other users",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: PresenceChanged, UserId: "stranger"},
+			delivery:      deliverNothing,
+		},
+		{
+			name:          "participants added to other conversations",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: AddParticipant, ConversationId: "other"},
+			delivery:      deliverEvent,
+		},
+		{
+			name:          "participants removed from other conversations",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: RemoveParticipant, ConversationId: "other"},
+			delivery:      deliverEvent,
+		},
+		{
+			name:          "conversations the user was added to",
+			subscriptions: subscribed,
+			event:         OutgoingEvent{Type: ConversationAdded, ConversationId: "other"},
+			delivery:      deliverEvent,
+		},
+		{
+			name:          "nothing with empty subscriptions",
+			subscriptions: map[string][]string{},
+			event:         OutgoingEvent{Type: TypingStarted, ConversationId: "other"},
+			delivery:      deliverNothing,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{id: "me", subscriptions: test.subscriptions}
+
+			if delivery := deliveryFor(client, test.event); delivery != test.delivery {
+				t.Errorf("deliveryFor = %v, want %v", delivery, test.delivery)
+			}
+		})
+	}
+}
+
+func TestUpdateSubscriptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		subscriptions map[string][]string
+		subscription  subscription
+		want          map[string][]string
+	}{
+		{
+			name:         "unsubscribe without subscriptions",
+			subscription: subscription{removed: []string{"focused"}},
+			want:         nil,
+		},
+		{
+			name:         "subscribe",
+			subscription: subscription{conversations: map[string][]string{"focused": {"me", "friend"}}},
+			want:         map[string][]string{"focused": {"me", "friend"}},
+		},
+		{
+			name:          "unsubscribe from some conversations",
+			subscriptions: map[string][]string{"focused": {"me", "friend"}, "other": {"me"}},
+			subscription:  subscription{removed: []string{"other"}},
+			want:          map[string][]string{"focused": {"me", "friend"}},
+		},
+		{
+			name:          "unsubscribe from the last conversation",
+			subscriptions: map[string][]string{"focused": {"me", "friend"}},
+			subscription:  subscription{removed: []string{"focused"}},
+			want:          nil,
+		},
+		{
+			name:          "reset",
+			subscriptions: map[string][]string{"focused": {"me", "friend"}},
+			subscription:  subscription{reset: true},
+			want:          nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &Client{id: "me", subscriptions: test.subscriptions}
+			test.subscription.client = client
+
+			(&Hub{}).updateSubscriptions(test.subscription)
+
+			if !reflect.DeepEqual(client.subscriptions, test.want) {
+				t.Errorf("subscriptions = %v, want %v", client.subscriptions, test.want)
+			}
+			// Typing stays delivered while the client has no subscriptions
+			if test.want == nil && deliveryFor(client, OutgoingEvent{Type: TypingStarted, ConversationId: "other"}) != deliverEvent {
+				t.Errorf("typing events are no longer delivered")
+			}
+		})
+	}
+}
+
+func TestRefreshSubscriptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		event         OutgoingEvent
+		subscriptions map[string]map[string][]string
+	}{
+		{
+			name: "added participants",
+			event: OutgoingEvent{
+				Type:              AddParticipant,
+				ConversationId:    "group",
+				Participants:      []string{"me", "friend"},
+				AddedParticipants: []string{"newcomer"},
+			},
+			subscriptions: map[string]map[string][]string{
+				"me":     {"group": {"me", "friend", "newcomer"}, "other": {"me", "stranger"}},
+				"friend": {"group": {"me", "friend", "newcomer"}},
+			},
+		},
+		{
+			name: "removed participants",
+			event: OutgoingEvent{
+				Type:                RemoveParticipant,
+				ConversationId:      "group",
+				Participants:        []string{"me", "friend"},
+				RemovedParticipants: []string{"friend"},
+			},
+			subscriptions: map[string]map[string][]string{
+				"me":     {"group": {"me"}, "other": {"me", "stranger"}},
+				"friend": nil,
+			},
+		},
+		{
+			name:  "other events",
+			event: OutgoingEvent{Type: AddMessage, ConversationId: "group", Participants: []string{"me", "friend"}},
+			subscriptions: map[string]map[string][]string{
+				"me":     {"group": {"me", "friend"}, "other": {"me", "stranger"}},
+				"friend": {"group": {"me", "friend"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			me := &Client{id: "me", subscriptions: map[string][]string{"group": {"me", "friend"}, "other": {"me", "stranger"}}}
+			friend := &Client{id: "friend", subscriptions: map[string][]string{"group": {"me", "friend"}}}
+			h := &Hub{clients: map[string][]*Client{"me": {me}, "friend": {friend}}}
+
+			h.refreshSubscriptions(test.event)
+
+			for _, client := range []*Client{me, friend} {
+				if !reflect.DeepEqual(client.subscriptions, test.subscriptions[client.id]) {
+					t.Errorf("subscriptions of %s = %v, want %v", client.id, client.subscriptions, test.subscriptions[client.id])
+				}
+			}
+		})
+	}
+}
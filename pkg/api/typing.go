@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"time"
+)
+
+// typingState tracks a typing indicator that is relayed to the other participants
+// of a conversation. Typing indicators are never persisted.
+type typingState struct {
+	timer        *time.Timer
+	participants []string
+}
+
+// startTyping relays a typing started event to the other participants of the
+// conversation, or extends the expiry of an indicator that is already active.
+// Conversations the user is not a participant of, or that do not exist, are
+// reported as forbidden.
+func (c *Client) startTyping(conversationId string) error {
+	c.typingMutex.Lock()
+	if state, ok := c.typing[conversationId]; ok && state.timer.Stop() {
+		state.timer.Reset(typingTimeout)
+		c.typingMutex.Unlock()
+		return nil
+	}
+	c.typingMutex.Unlock()
+
+	participants, err := c.chatService.GetParticipants(conversationId)
+	if errors.Is(err, ErrConversationNotFound) {
+		return ErrForbidden
+	} else if err != nil {
+		return err
+	}
+
+	// Only participants can signal typing and they never receive their own indicator
+	var isParticipant bool
+	var recipients []string
+	for _, id := range participants {
+		if id == c.id {
+			isParticipant = true
+		} else {
+			recipients = append(recipients, id)
+		}
+	}
+	if !isParticipant {
+		return ErrForbidden
+	}
+
+	state := &typingState{participants: recipients}
+	state.timer = time.AfterFunc(typingTimeout, func() {
+		c.stopTyping(conversationId, state)
+	})
+
+	c.typingMutex.Lock()
+	c.typing[conversationId] = state
+	c.typingMutex.Unlock()
+
+	c.Hub.Send(OutgoingEvent{
+		ConversationId: conversationId,
+		Type:           TypingStarted,
+		Participants:   recipients,
+		UserId:         c.id,
+	})
+
+	return nil
+}
+
+// stopTyping relays a typing stopped event for an active indicator. When expected
+// is set, the indicator is only stopped if it is still the one that expired.
+func (c *Client) stopTyping(conversationId string, expected *typingState) {
+	c.typingMutex.Lock()
+	state, ok := c.typing[conversationId]
+	if !ok || (expected != nil && state != expected) {
+		c.typingMutex.Unlock()
+		return
+	}
+	delete(c.typing, conversationId)
+	c.typingMutex.Unlock()
+
+	state.timer.Stop()
+
+	c.Hub.Send(OutgoingEvent{
+		ConversationId: conversationId,
+		Type:           TypingStopped,
+		Participants:   state.participants,
+		UserId:         c.id,
+	})
+}
+
+// stopAllTyping stops every active typing indicator of the Client.
+func (c *Client) stopAllTyping() {
+	c.typingMutex.Lock()
+	conversationIds := make([]string, 0, len(c.typing))
+	for conversationId := range c.typing {
+		conversationIds = append(conversationIds, conversationId)
+	}
+	c.typingMutex.Unlock()
+
+	for _, conversationId := range conversationIds {
+		c.stopTyping(conversationId, nil)
+	}
+}
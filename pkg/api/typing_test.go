@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// participantsService returns the participants of the conversations it knows.
+type participantsService struct {
+	ChatService
+	participants map[string][]string
+	err          error
+}
+
+func (s participantsService) GetParticipants(conversationId string) ([]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	participants, ok := s.participants[conversationId]
+	if !ok {
+		return nil, ErrConversationNotFound
+	}
+	return participants, nil
+}
+
+func TestTypingStarted(t *testing.T) {
+	tests := []struct {
+		name           string
+		conversationId string
+		err            error
+		frameType      string
+		code           string
+	}{
+		{name: "participant", conversationId: "mine", frameType: Ack},
+		{name: "other conversation", conversationId: "theirs", frameType: Error, code: ErrorCodeForbidden},
+		{name: "unknown conversation", conversationId: "unknown", frameType: Error, code: ErrorCodeForbidden},
+		{name: "storage error", conversationId: "mine", err: errors.New("unavailable"), frameType: Error, code: ErrorCodeInternal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &Hub{direct: make(chan directMessage, 1), send: make(chan OutgoingEvent, 1), done: make(chan struct{})}
+			client := &Client{
+				id:     "me",
+				Hub:    h,
+				codec:  JSONCodec,
+				typing: make(map[string]*typingState),
+				chatService: participantsService{
+					participants: map[string][]string{"mine": {"me", "friend"}, "theirs": {"friend", "stranger"}},
+					err:          test.err,
+				},
+			}
+			defer client.stopAllTyping()
+
+			client.handle("1", IncomingEvent{Type: TypingStarted, ConversationId: test.conversationId})
+
+			var frame struct {
+				Type    string       `json:"type"`
+				Id      string       `json:"id"`
+				Payload ErrorPayload `json:"payload"`
+			}
+			if err := json.Unmarshal((<-h.direct).message, &frame); err != nil {
+				t.Fatalf("Unable to decode frame: %v", err)
+			}
+			if frame.Type != test.frameType || frame.Id != "1" || frame.Payload.Code != test.code {
+				t.Errorf("frame = %s %s %q, want %s 1 %q", frame.Type, frame.Id, frame.Payload.Code, test.frameType, test.code)
+			}
+
+			// Only participants relay their indicator
+			select {
+			case <-h.send:
+				if test.frameType != Ack {
+					t.Errorf("typing was relayed")
+				}
+			default:
+				if test.frameType == Ack {
+					t.Errorf("typing was not relayed")
+				}
+			}
+		})
+	}
+}
@@ -1,15 +1,22 @@
 package api
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 type UserService interface {
 	GetUserByIds(userIds []string) ([]*UserModel, error)
 	GetUsersByUsernameContaining(query string) ([]*UserModel, error)
+	UpdateInstancePresence(instance string, presence UserPresence, expiresAt time.Time) (UserPresence, bool, error)
+	RefreshInstancePresence(instance string, expiresAt time.Time) ([]UserPresence, error)
 }
 
 type UserRepository interface {
 	GetUserByIds(userIds []string) ([]*UserModel, error)
 	GetUsersByUsernameContaining(query string) ([]*UserModel, error)
+	UpdateInstancePresence(instance string, presence UserPresence, expiresAt time.Time) (UserPresence, bool, error)
+	RefreshInstancePresence(instance string, expiresAt time.Time) ([]UserPresence, error)
 }
 
 type userService struct {
@@ -47,3 +54,33 @@ func (u userService) GetUsersByUsernameContaining(username string) ([]*UserModel
 
 	return user, nil
 }
+
+// UpdateInstancePresence stores the status of the connections an instance holds
+// for a user until expiresAt. It returns the status of the user across all
+// instances and whether it changed.
+func (u userService) UpdateInstancePresence(instance string, presence UserPresence, expiresAt time.Time) (UserPresence, bool, error) {
+	if presence.UserId == "" {
+		return presence, false, errors.New("userId is empty")
+	}
+
+	presence, changed, err := u.storage.UpdateInstancePresence(instance, presence, expiresAt)
+
+	if err != nil {
+		return presence, false, err
+	}
+
+	return presence, changed, nil
+}
+
+// RefreshInstancePresence extends the statuses stored by an instance until
+// expiresAt and expires those of instances that stopped refreshing them. It
+// returns the users whose status changed.
+func (u userService) RefreshInstancePresence(instance string, expiresAt time.Time) ([]UserPresence, error) {
+	presences, err := u.storage.RefreshInstancePresence(instance, expiresAt)
+
+	if err != nil {
+		return presences, err
+	}
+
+	return presences, nil
+}
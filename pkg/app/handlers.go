@@ -1,24 +1,32 @@
 package app
 
 import (
+	"chatService/config"
 	"chatService/pkg/api"
-	"cloud.google.com/go/firestore"
+	myMiddleware "chatService/pkg/middleware"
 	"encoding/json"
+	"errors"
+	"firebase.google.com/go/v4/auth"
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  8092,
-	WriteBufferSize: 8092,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+func newUpgrader(config config.Websocket) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:    config.ReadBufferSize,
+		WriteBufferSize:   config.WriteBufferSize,
+		EnableCompression: config.EnableCompression,
+		Subprotocols:      api.Subprotocols(),
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
 }
 
 func (s *Server) UpdateConversation() http.HandlerFunc {
@@ -27,26 +35,6 @@ func (s *Server) UpdateConversation() http.HandlerFunc {
 	}
 }
 
-func (s *Server) UpdateUserConversation() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// UID from Access Token contained in Authorization header
-		uid := r.Context().Value("UID").(string)
-
-		conversationId := chi.URLParam(r, "conversationId")
-
-		patchJSON, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Fatalf("Reading bytes from request: %v", err)
-		}
-
-		if err := s.chatService.UpdateUserConversation(patchJSON, uid, conversationId); err != nil {
-			http.Error(w, "Couldn't process request", http.StatusBadRequest)
-		}
-
-		w.WriteHeader(http.StatusNoContent)
-	}
-}
-
 func (s *Server) GetConversation() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// UID from Access Token contained in Authorization header
@@ -119,34 +107,43 @@ func (s *Server) GetContacts() http.HandlerFunc {
 	}
 }
 
-func (s *Server) MarkConversationAsRead() http.HandlerFunc {
+func (s *Server) MarkConversationAsRead(hub *api.Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve firestore client from context
-		client := r.Context().Value("firestore").(*firestore.Client)
 		// UID from Access Token contained in Authorization header
 		uid := r.Context().Value("UID").(string)
 
 		conversationId := chi.URLParam(r, "conversationId")
 
-		// Get Conversation sub-collection in User collection
-		userRef := client.Collection("users").Doc(uid)
-		conversationRef := userRef.Collection("conversations").Doc(conversationId)
-		_, err := conversationRef.Update(r.Context(), []firestore.Update{
-			{
-				Path:  "unreadCount",
-				Value: 0,
-			},
-		})
-		if status.Code(err) == codes.NotFound {
+		// Without a message id the conversation is read up to the latest message
+		incomingEvent := api.IncomingEvent{
+			ConversationId: conversationId,
+			Type:           api.ReadMessages,
+			Message:        &api.Message{Id: r.URL.Query().Get("messageId")},
+		}
+
+		outgoingEvent, err := s.chatService.MarkConversationAsRead(incomingEvent, uid)
+		if errors.Is(err, api.ErrForbidden) || errors.Is(err, api.ErrNotParticipant) || errors.Is(err, api.ErrMessageNotFound) {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error marking conversation with conversation id:"+conversationId+" as read", http.StatusBadRequest)
+			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		// Let the other participants know how far the user has read
+		hub.Send(outgoingEvent)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(outgoingEvent.ReadReceipt); err != nil {
+			log.Printf("Unable to encode read receipt data: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		log.Printf("Marked conversation with id %s as read\n", conversationId)
 	}
 }
 
-func (s *Server) CreateConversation() http.HandlerFunc {
+func (s *Server) CreateConversation(hub *api.Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// UID from Access Token contained in Authorization header
 		uid := r.Context().Value("UID").(string)
@@ -161,9 +158,26 @@ func (s *Server) CreateConversation() http.HandlerFunc {
 		}
 
 		conversation, err := s.chatService.CreateConversation(newConversation, uid)
-
-		if err != nil {
+		if errors.Is(err, api.ErrConversationExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if errors.Is(err, api.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Participants receive the conversation so it shows up in their list
+		if conversation.Id != "" {
+			outgoingEvents, err := s.chatService.GetConversationAddedEvents(conversation.Id, newConversation.Participants)
+			if err != nil {
+				log.Printf("Unable to get conversation %s for participants: %v", conversation.Id, err)
+			}
+			for _, outgoingEvent := range outgoingEvents {
+				hub.Send(outgoingEvent)
+			}
 		}
 
 		w.WriteHeader(http.StatusCreated)
@@ -175,13 +189,241 @@ func (s *Server) CreateConversation() http.HandlerFunc {
 	}
 }
 
+func (s *Server) GetThread() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// UID from Access Token contained in Authorization header
+		uid := r.Context().Value("UID").(string)
+
+		conversationId := chi.URLParam(r, "conversationId")
+		messageId := chi.URLParam(r, "messageId")
+
+		// Replies created before this time are returned, starting with the newest
+		var before time.Time
+		if value := r.URL.Query().Get("before"); value != "" {
+			var err error
+			if before, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var limit int
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		thread, err := s.chatService.GetThread(uid, conversationId, messageId, before, limit)
+		if errors.Is(err, api.ErrNotParticipant) || errors.Is(err, api.ErrMessageNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error getting thread of message with message id:"+messageId, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(thread); err != nil {
+			log.Printf("Unable to encode thread data: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("Successfully retrieved thread of message with id: %s", messageId)
+	}
+}
+
+func (s *Server) MarkThreadAsRead() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// UID from Access Token contained in Authorization header
+		uid := r.Context().Value("UID").(string)
+
+		conversationId := chi.URLParam(r, "conversationId")
+		messageId := chi.URLParam(r, "messageId")
+
+		err := s.chatService.MarkThreadAsRead(uid, conversationId, messageId)
+		if errors.Is(err, api.ErrNotParticipant) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error marking thread of message with message id:"+messageId+" as read", http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("Marked thread of message with id %s as read\n", messageId)
+	}
+}
+
+func (s *Server) AddReaction(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.updateReaction(w, r, hub, api.AddReaction)
+	}
+}
+
+func (s *Server) RemoveReaction(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.updateReaction(w, r, hub, api.RemoveReaction)
+	}
+}
+
+func (s *Server) updateReaction(w http.ResponseWriter, r *http.Request, hub *api.Hub, requestType string) {
+	// UID from Access Token contained in Authorization header
+	uid := r.Context().Value("UID").(string)
+
+	conversationId := chi.URLParam(r, "conversationId")
+	messageId := chi.URLParam(r, "messageId")
+
+	// Emoji arrive percent-encoded in the path
+	reaction, err := url.PathUnescape(chi.URLParam(r, "reaction"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Replies are found through their parent message
+	incomingEvent := api.IncomingEvent{
+		ConversationId: conversationId,
+		Type:           requestType,
+		Message:        &api.Message{Id: messageId, ParentMessageId: r.URL.Query().Get("parentMessageId")},
+		Reaction:       reaction,
+	}
+
+	var outgoingEvent api.OutgoingEvent
+	if requestType == api.AddReaction {
+		outgoingEvent, err = s.chatService.AddReaction(incomingEvent, uid)
+	} else {
+		outgoingEvent, err = s.chatService.RemoveReaction(incomingEvent, uid)
+	}
+	if errors.Is(err, api.ErrMessageNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if errors.Is(err, api.ErrForbidden) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Error updating reactions of message with message id:"+messageId, http.StatusBadRequest)
+		return
+	}
+
+	// Notify participants about the updated reactions
+	hub.Send(outgoingEvent)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(outgoingEvent.Message); err != nil {
+		log.Printf("Unable to encode message data: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	log.Printf("Successfully updated reactions of message with id: %s", messageId)
+}
+
+func (s *Server) LeaveConversation(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// UID from Access Token contained in Authorization header
+		uid := r.Context().Value("UID").(string)
+
+		conversationId := chi.URLParam(r, "conversationId")
+
+		// Leaving a conversation is removing yourself as a participant
+		incomingEvent := api.IncomingEvent{
+			ConversationId: conversationId,
+			Type:           api.RemoveParticipant,
+			Participants:   []string{uid},
+		}
+
+		outgoingEvent, err := s.chatService.RemoveParticipant(incomingEvent, uid)
+		if errors.Is(err, api.ErrForbidden) || errors.Is(err, api.ErrNotParticipant) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if errors.Is(err, api.ErrOneToOneConversation) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, "Error leaving conversation with conversation id:"+conversationId, http.StatusBadRequest)
+			return
+		}
+
+		// Notify remaining participants and the user's other devices
+		hub.Send(outgoingEvent)
+
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("User %s left conversation with id: %s", uid, conversationId)
+	}
+}
+
+func (s *Server) EditMessage(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// UID from Access Token contained in Authorization header
+		uid := r.Context().Value("UID").(string)
+
+		conversationId := chi.URLParam(r, "conversationId")
+		messageId := chi.URLParam(r, "messageId")
+
+		var message api.Message
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&message); err != nil {
+			log.Printf("Unable to unmarshal request body: %v\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		message.Id = messageId
+
+		incomingEvent := api.IncomingEvent{
+			ConversationId: conversationId,
+			Type:           api.EditMessage,
+			Message:        &message,
+		}
+
+		outgoingEvent, err := s.chatService.EditMessage(incomingEvent, uid)
+		if errors.Is(err, api.ErrMessageNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if errors.Is(err, api.ErrNotMessageSender) || errors.Is(err, api.ErrForbidden) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, "Error editing message with message id:"+messageId, http.StatusBadRequest)
+			return
+		}
+
+		// Notify participants about the updated message
+		hub.Send(outgoingEvent)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(outgoingEvent.Message); err != nil {
+			log.Printf("Unable to encode message data: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("Successfully edited message with id: %s", messageId)
+	}
+}
+
 func (s *Server) ServeWs(hub *api.Hub) http.HandlerFunc {
+	upgrader := newUpgrader(s.websocket)
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		uid := r.URL.Query().Get("uid")
-		if uid == "" {
-			log.Println("uid in query param required")
+		// Access Token verified before the connection is upgraded
+		token := r.Context().Value("token").(*auth.Token)
+		firebaseAuth := r.Context().Value("auth").(*auth.Client)
+
+		// Clients reconnect to another instance while this one shuts down
+		if hub.Draining() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.websocket.ReconnectAfter.Seconds())))
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
 			return
 		}
+
+		// Clients that ask for protocols must support the current protocol version
+		if protocols := requestedProtocols(r); len(protocols) > 0 && !supportsProtocol(protocols) {
+			http.Error(w, "Unsupported protocol, expected one of "+strings.Join(api.Subprotocols(), ", "), http.StatusBadRequest)
+			return
+		}
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println(err)
@@ -189,8 +431,14 @@ func (s *Server) ServeWs(hub *api.Hub) http.HandlerFunc {
 		}
 
 		log.Println("Connected to websocket")
-		client := api.NewClient(hub, conn, make(chan []byte, 256), uid, s.chatService)
-		client.Hub.Register <- client
+		client := api.NewClient(hub, conn, token, firebaseAuth, s.chatService)
+		if !hub.Register(client) {
+			_ = conn.Close()
+			return
+		}
+
+		// Announcements published before the user connected
+		go client.SendAnnouncements(s.announcementService)
 
 		// Allow collection of memory referenced by the caller by doing all work in
 		// new goroutines.
@@ -198,3 +446,285 @@ func (s *Server) ServeWs(hub *api.Hub) http.HandlerFunc {
 		go client.ReadPump()
 	}
 }
+
+// requestedProtocols returns the subprotocols asked for by the client, leaving out
+// the entry carrying the access token.
+func requestedProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, protocol := range websocket.Subprotocols(r) {
+		if !strings.HasPrefix(protocol, myMiddleware.TokenProtocolPrefix) {
+			protocols = append(protocols, protocol)
+		}
+	}
+	return protocols
+}
+
+func supportsProtocol(protocols []string) bool {
+	for _, protocol := range protocols {
+		if _, ok := api.CodecFor(protocol); ok && protocol != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) GetConnections(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		connections := hub.Connections()
+		if connections == nil {
+			connections = []api.UserConnections{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(connections); err != nil {
+			log.Printf("Could not encode json: %v", err)
+		}
+	}
+}
+
+func (s *Server) GetUserConnections(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := chi.URLParam(r, "userId")
+
+		connections, ok := hub.UserConnections(userId)
+		if !ok {
+			http.Error(w, "User is not connected", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(connections); err != nil {
+			log.Printf("Could not encode json: %v", err)
+		}
+	}
+}
+
+func (s *Server) DisconnectUser(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := chi.URLParam(r, "userId")
+		sessionId := chi.URLParam(r, "sessionId")
+
+		// Sessions held by other instances are closed once they receive the request
+		hub.Disconnect(userId, sessionId)
+
+		log.Printf("Admin %s disconnected user %s", r.Context().Value("UID").(string), userId)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (s *Server) GetHubStats(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(hub.Stats()); err != nil {
+			log.Printf("Could not encode json: %v", err)
+		}
+	}
+}
+
+func (s *Server) CreateAnnouncement(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid := r.Context().Value("UID").(string)
+
+		var announcement api.Announcement
+		if err := json.NewDecoder(r.Body).Decode(&announcement); err != nil {
+			http.Error(w, "Invalid announcement", http.StatusBadRequest)
+			return
+		}
+
+		announcement, err := s.announcementService.CreateAnnouncement(announcement, uid)
+		if errors.Is(err, api.ErrInvalidAnnouncement) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Unable to create announcement: %v", err)
+			http.Error(w, "Unable to create announcement", http.StatusInternalServerError)
+			return
+		}
+
+		hub.Announce(announcement)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(announcement); err != nil {
+			log.Printf("Could not encode json: %v", err)
+		}
+	}
+}
+
+func (s *Server) GetAnnouncements() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		announcements, err := s.announcementService.GetAnnouncements()
+		if err != nil {
+			log.Printf("Unable to get announcements: %v", err)
+			http.Error(w, "Unable to get announcements", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(announcements); err != nil {
+			log.Printf("Could not encode json: %v", err)
+		}
+	}
+}
+
+func (s *Server) ExpireAnnouncement(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		announcementId := chi.URLParam(r, "announcementId")
+
+		announcement, err := s.announcementService.ExpireAnnouncement(announcementId)
+		if errors.Is(err, api.ErrAnnouncementNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Unable to expire announcement %s: %v", announcementId, err)
+			http.Error(w, "Unable to expire announcement", http.StatusInternalServerError)
+			return
+		}
+
+		hub.Withdraw(announcement)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TrackActivity marks the event streams of the user as active on every request,
+// since those streams cannot send anything themselves.
+func (s *Server) TrackActivity(hub *api.Hub) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hub.Touch(r.Context().Value("UID").(string))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) ServeEvents(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Access Token verified by the Authenticator, EventSource sends it as a query param
+		token := r.Context().Value("token").(*auth.Token)
+		firebaseAuth := r.Context().Value("auth").(*auth.Client)
+
+		if hub.Draining() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.websocket.ReconnectAfter.Seconds())))
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// EventSource polyfills that cannot set headers send the last event id as a query param
+		lastEventId := r.Header.Get("Last-Event-ID")
+		if lastEventId == "" {
+			lastEventId = r.URL.Query().Get("lastEventId")
+		}
+
+		client := api.NewEventStreamClient(hub, token, firebaseAuth, s.chatService, r.RemoteAddr, lastEventId)
+		if !hub.Register(client.Client) {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		log.Println("Connected to event stream")
+
+		// Announcements published before the user connected
+		go client.SendAnnouncements(s.announcementService)
+
+		client.Serve(r.Context(), w, flusher)
+	}
+}
+
+func (s *Server) AddMessage(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// UID from Access Token contained in Authorization header
+		uid := r.Context().Value("UID").(string)
+
+		conversationId := chi.URLParam(r, "conversationId")
+
+		var message api.Message
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&message); err != nil {
+			log.Printf("Unable to unmarshal request body: %v\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		incomingEvent := api.IncomingEvent{
+			ConversationId: conversationId,
+			Type:           api.AddMessage,
+			Message:        &message,
+		}
+
+		outgoingEvent, err := s.chatService.AddMessage(incomingEvent, uid)
+		if errors.Is(err, api.ErrForbidden) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		} else if errors.Is(err, api.ErrInvalidMessage) || errors.Is(err, api.ErrInvalidClientKey) || errors.Is(err, api.ErrMessageNotFound) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Error adding message to conversation with id:"+conversationId, http.StatusBadRequest)
+			return
+		}
+
+		// Retried messages were already delivered by the first attempt
+		status := http.StatusOK
+		if !outgoingEvent.Duplicate {
+			// Notify participants, including the other devices of the sender
+			hub.Send(outgoingEvent)
+			status = http.StatusCreated
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(outgoingEvent.Message); err != nil {
+			log.Printf("Unable to encode message data: %v\n", err)
+			return
+		}
+		log.Printf("Successfully added message to conversation with id: %s", conversationId)
+	}
+}
+
+func (s *Server) RemoveMessage(hub *api.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// UID from Access Token contained in Authorization header
+		uid := r.Context().Value("UID").(string)
+
+		conversationId := chi.URLParam(r, "conversationId")
+		messageId := chi.URLParam(r, "messageId")
+
+		// Replies are found through their parent message
+		incomingEvent := api.IncomingEvent{
+			ConversationId: conversationId,
+			Type:           api.RemoveMessage,
+			Message:        &api.Message{Id: messageId, ParentMessageId: r.URL.Query().Get("parentMessageId")},
+		}
+
+		outgoingEvent, err := s.chatService.RemoveMessage(incomingEvent, uid)
+		if errors.Is(err, api.ErrMessageNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if errors.Is(err, api.ErrNotMessageSender) || errors.Is(err, api.ErrForbidden) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, "Error removing message with message id:"+messageId, http.StatusBadRequest)
+			return
+		}
+
+		// Notify participants about the removed message
+		hub.Send(outgoingEvent)
+
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("Successfully removed message with id: %s", messageId)
+	}
+}
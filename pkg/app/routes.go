@@ -17,20 +17,46 @@ func (s *Server) Routes(hub *api.Hub) *chi.Mux {
 		AllowCredentials: false,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
-	r.Use(middleware.Logger)
+	r.Use(myMiddleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(myMiddleware.FirebaseConfig(config.SetupFirebase()))
 
 	r.Route("/chat", func(r chi.Router) {
 		r.Use(myMiddleware.Authenticator)
-		r.Get("/conversation/{conversationId}", s.GetConversation())
-		r.Post("/conversation", s.CreateConversation())
-		r.Get("/conversation", s.GetConversations())
-		r.Patch("/conversation/{conversationId}", s.UpdateConversation())
-		r.Patch("/user/conversation/{conversationId}", s.UpdateUserConversation())
+		r.Get("/ws", s.ServeWs(hub))
+		r.Get("/events", s.ServeEvents(hub))
+
+		// Requests keep the event streams of the user active
+		r.Group(func(r chi.Router) {
+			r.Use(s.TrackActivity(hub))
+			r.Get("/conversation/{conversationId}", s.GetConversation())
+			r.Post("/conversation", s.CreateConversation(hub))
+			r.Get("/conversation", s.GetConversations())
+			r.Patch("/conversation/{conversationId}", s.UpdateConversation())
+			r.Post("/conversation/{conversationId}/message", s.AddMessage(hub))
+			r.Patch("/conversation/{conversationId}/message/{messageId}", s.EditMessage(hub))
+			r.Delete("/conversation/{conversationId}/message/{messageId}", s.RemoveMessage(hub))
+			r.Get("/conversation/{conversationId}/message/{messageId}/thread", s.GetThread())
+			r.Post("/conversation/{conversationId}/message/{messageId}/thread/read", s.MarkThreadAsRead())
+			r.Put("/conversation/{conversationId}/message/{messageId}/reaction/{reaction}", s.AddReaction(hub))
+			r.Delete("/conversation/{conversationId}/message/{messageId}/reaction/{reaction}", s.RemoveReaction(hub))
+			r.Delete("/user/conversation/{conversationId}", s.LeaveConversation(hub))
+			r.Post("/user/conversation/{conversationId}/read", s.MarkConversationAsRead(hub))
+		})
 	})
 
-	r.Get("/chat/ws", s.ServeWs(hub))
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(myMiddleware.Authenticator)
+		r.Use(myMiddleware.AdminOnly)
+		r.Get("/connections", s.GetConnections(hub))
+		r.Get("/connections/{userId}", s.GetUserConnections(hub))
+		r.Delete("/connections/{userId}", s.DisconnectUser(hub))
+		r.Delete("/connections/{userId}/{sessionId}", s.DisconnectUser(hub))
+		r.Get("/stats", s.GetHubStats(hub))
+		r.Post("/announcements", s.CreateAnnouncement(hub))
+		r.Get("/announcements", s.GetAnnouncements())
+		r.Delete("/announcements/{announcementId}", s.ExpireAnnouncement(hub))
+	})
 
 	return r
 }
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"chatService/config"
 	"chatService/pkg/api"
 	"context"
 	"github.com/go-chi/chi/v5"
@@ -16,18 +17,28 @@ type Server struct {
 	router      *chi.Mux
 	userService api.UserService
 	chatService api.ChatService
+
+	announcementService api.AnnouncementService
+
+	websocket config.Websocket
+	backplane api.Backplane
 }
 
-func NewServer(router *chi.Mux, userService api.UserService, chatService api.ChatService) *Server {
+func NewServer(router *chi.Mux, userService api.UserService, chatService api.ChatService, announcementService api.AnnouncementService, websocket config.Websocket, backplane api.Backplane) *Server {
 	return &Server{
-		router:      router,
-		userService: userService,
-		chatService: chatService,
+		router:              router,
+		userService:         userService,
+		chatService:         chatService,
+		announcementService: announcementService,
+		websocket:           websocket,
+		backplane:           backplane,
 	}
 }
 
 func (s *Server) Run() error {
-	hub := api.NewHub()
+	presence := api.NewPresenceTracker(s.userService, s.chatService)
+	hub := api.NewHub(presence, s.websocket, s.backplane)
+	go presence.Run()
 	go hub.Run()
 
 	// run function that initializes the routes
@@ -57,6 +68,12 @@ func (s *Server) Run() error {
 			}
 		}()
 
+		// Reject new websocket connections and close the existing ones, which
+		// http.Server.Shutdown does not track once they are hijacked
+		if err := hub.Shutdown(shutdownCtx, s.websocket.ReconnectAfter); err != nil {
+			log.Printf("Unable to drain websocket connections: %v", err)
+		}
+
 		// Trigger graceful shutdown
 		if err := server.Shutdown(shutdownCtx); err != nil {
 			log.Fatal(err)
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"firebase.google.com/go/v4/auth"
+	"net/http"
+)
+
+// AdminClaim is the custom claim granting access to the admin API.
+const AdminClaim = "admin"
+
+// AdminOnly rejects requests whose ID token lacks the admin claim. It must run
+// after Authenticator.
+func AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := r.Context().Value("token").(*auth.Token)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if isAdmin, _ := token.Claims[AdminClaim].(bool); !isAdmin {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"context"
 	"firebase.google.com/go/v4/auth"
+	"github.com/gorilla/websocket"
 	"net/http"
 	"strings"
 )
@@ -12,7 +13,7 @@ func Authenticator(next http.Handler) http.Handler {
 
 		firebaseAuth := r.Context().Value("auth").(*auth.Client)
 
-		idToken := findToken(r, tokenFromHeader, tokenFromQuery)
+		idToken := findToken(r, tokenFromHeader, tokenFromProtocol, tokenFromQuery)
 
 		token, err := firebaseAuth.VerifyIDToken(context.Background(), idToken)
 		if err != nil {
@@ -20,6 +21,7 @@ func Authenticator(next http.Handler) http.Handler {
 			return
 		}
 		ctx := context.WithValue(r.Context(), "UID", token.UID)
+		ctx = context.WithValue(ctx, "token", token)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -33,6 +35,20 @@ func tokenFromHeader(r *http.Request) string {
 	return ""
 }
 
+// TokenProtocolPrefix marks the entry of the Sec-WebSocket-Protocol header carrying
+// the ID token, since browsers cannot set headers on websocket requests.
+const TokenProtocolPrefix = "bearer."
+
+func tokenFromProtocol(r *http.Request) string {
+	// Get token from websocket subprotocol named "bearer.<token>".
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, TokenProtocolPrefix) {
+			return protocol[len(TokenProtocolPrefix):]
+		}
+	}
+	return ""
+}
+
 func tokenFromQuery(r *http.Request) string {
 	// Get token from query param named "token".
 	return r.URL.Query().Get("token")
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"github.com/go-chi/chi/v5/middleware"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Query parameters whose values are replaced in the request log.
+var redactedParams = []string{"token"}
+
+// Logger logs every request like chi's Logger, with the ID token that event
+// stream and websocket clients pass in the query string redacted.
+func Logger(next http.Handler) http.Handler {
+	return middleware.RequestLogger(redactingFormatter{
+		LogFormatter: &middleware.DefaultLogFormatter{Logger: log.New(os.Stderr, "", log.LstdFlags)},
+	})(next)
+}
+
+// redactingFormatter hides secrets in the request line before it is logged.
+type redactingFormatter struct {
+	middleware.LogFormatter
+}
+
+func (f redactingFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	query := r.URL.Query()
+
+	redacted := false
+	for _, param := range redactedParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return f.LogFormatter.NewLogEntry(r)
+	}
+
+	// The handlers still read the original request
+	logged := r.Clone(r.Context())
+	logged.URL.RawQuery = query.Encode()
+	logged.RequestURI = logged.URL.RequestURI()
+
+	return f.LogFormatter.NewLogEntry(logged)
+}
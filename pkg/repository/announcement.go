@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"chatService/pkg/api"
+	"cloud.google.com/go/firestore"
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"time"
+)
+
+func (s *storage) CreateAnnouncement(announcement api.Announcement) (api.Announcement, error) {
+	ctx := context.Background()
+
+	announcementRef := s.client.Collection("announcements").NewDoc()
+	if _, err := announcementRef.Create(ctx, announcement); err != nil {
+		log.Printf("Creating announcement: %v", err)
+		return api.Announcement{}, err
+	}
+
+	announcement.Id = announcementRef.ID
+	return announcement, nil
+}
+
+func (s *storage) GetActiveAnnouncements(now time.Time) ([]api.Announcement, error) {
+	ctx := context.Background()
+
+	announcementSnaps, err := s.client.Collection("announcements").
+		Where("expiresAt", ">", now).
+		OrderBy("expiresAt", firestore.Asc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	announcements := make([]api.Announcement, 0, len(announcementSnaps))
+	for _, announcementSnap := range announcementSnaps {
+		var announcement api.Announcement
+		if err := announcementSnap.DataTo(&announcement); err != nil {
+			log.Printf("Converting announcement snap to model struct: %v", err)
+			return nil, err
+		}
+		announcement.Id = announcementSnap.Ref.ID
+		announcements = append(announcements, announcement)
+	}
+
+	return announcements, nil
+}
+
+func (s *storage) ExpireAnnouncement(announcementId string, expiresAt time.Time) (api.Announcement, error) {
+	ctx := context.Background()
+	var announcement api.Announcement
+
+	announcementRef := s.client.Collection("announcements").Doc(announcementId)
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		announcementSnap, err := tx.Get(announcementRef)
+		if status.Code(err) == codes.NotFound {
+			return api.ErrAnnouncementNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if err := announcementSnap.DataTo(&announcement); err != nil {
+			return err
+		}
+
+		// Announcements that already expired are reported as missing
+		if !announcement.ExpiresAt.After(expiresAt) {
+			return api.ErrAnnouncementNotFound
+		}
+
+		announcement.Id = announcementRef.ID
+		announcement.ExpiresAt = expiresAt
+		return tx.Update(announcementRef, []firestore.Update{
+			{Path: "expiresAt", Value: expiresAt},
+		})
+	})
+	if err != nil {
+		return api.Announcement{}, err
+	}
+
+	return announcement, nil
+}
@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"chatService/pkg/api"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Channel the hubs of all instances listen on.
+	backplaneChannel = "chat_hub"
+
+	// Largest message sent as a notification payload. Postgres limits payloads to
+	// 8000 bytes, larger messages are stored in the backplane_event table.
+	maxNotifyPayload = 7900
+
+	// Prefix of notification payloads that reference a stored message.
+	storedPayloadPrefix = "ref:"
+
+	// Time after which stored messages are deleted.
+	storedPayloadRetention = time.Minute
+
+	// Number of messages waiting to be published or handed to the Hub.
+	backplaneBuffer = 1024
+
+	// Delay before listening again after the connection was lost.
+	listenRetryDelay = time.Second
+)
+
+var ErrBackplaneFull = errors.New("backplane publish queue is full")
+
+// postgresBackplane relays hub messages between instances with LISTEN/NOTIFY.
+type postgresBackplane struct {
+	db *pgxpool.Pool
+
+	// Messages waiting to be published, so the Hub never waits for the database
+	outgoing chan []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	closeOnce sync.Once
+}
+
+// NewPostgresBackplane returns a Backplane relaying messages through the database.
+// The backplane_event table is created by the migrations.
+func NewPostgresBackplane(db *pgxpool.Pool) api.Backplane {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	backplane := &postgresBackplane{
+		db:       db,
+		outgoing: make(chan []byte, backplaneBuffer),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go backplane.runPublisher()
+
+	return backplane
+}
+
+func (b *postgresBackplane) Publish(message []byte) error {
+	if b.ctx.Err() != nil {
+		return api.ErrBackplaneClosed
+	}
+
+	select {
+	case b.outgoing <- message:
+		return nil
+	default:
+		return ErrBackplaneFull
+	}
+}
+
+func (b *postgresBackplane) Subscribe() (<-chan []byte, error) {
+	if b.ctx.Err() != nil {
+		return nil, api.ErrBackplaneClosed
+	}
+
+	messages := make(chan []byte, backplaneBuffer)
+	go b.runListener(messages)
+
+	return messages, nil
+}
+
+func (b *postgresBackplane) Close() error {
+	b.closeOnce.Do(b.cancel)
+	return nil
+}
+
+// runPublisher sends queued messages and deletes expired stored messages.
+func (b *postgresBackplane) runPublisher() {
+	ticker := time.NewTicker(storedPayloadRetention)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case message := <-b.outgoing:
+			if err := b.notify(message); err != nil {
+				log.Printf("Unable to publish backplane message: %v", err)
+			}
+		case <-ticker.C:
+			if err := b.deleteExpired(); err != nil {
+				log.Printf("Unable to delete expired backplane messages: %v", err)
+			}
+		}
+	}
+}
+
+// deleteExpired deletes stored messages older than their retention. Listeners
+// load stored messages right after the notification, so expired ones are no
+// longer needed by any instance.
+func (b *postgresBackplane) deleteExpired() error {
+	_, err := b.db.Exec(b.ctx, `DELETE FROM backplane_event WHERE created_at < $1`, time.Now().Add(-storedPayloadRetention))
+	return err
+}
+
+func (b *postgresBackplane) notify(message []byte) error {
+	payload := string(message)
+
+	if len(payload) > maxNotifyPayload {
+		var id int64
+		err := b.db.QueryRow(b.ctx, `INSERT INTO backplane_event (payload) VALUES ($1) RETURNING id`, payload).Scan(&id)
+		if err != nil {
+			return err
+		}
+		payload = storedPayloadPrefix + strconv.FormatInt(id, 10)
+	}
+
+	_, err := b.db.Exec(b.ctx, `SELECT pg_notify($1, $2)`, backplaneChannel, payload)
+	return err
+}
+
+// runListener receives notifications until the backplane is closed, listening
+// again whenever the connection is lost. Messages published while the listener
+// reconnects are lost; clients recover them with a sync request.
+func (b *postgresBackplane) runListener(messages chan<- []byte) {
+	defer close(messages)
+
+	for {
+		err := b.listen(messages)
+		if b.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Lost backplane connection: %v", err)
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (b *postgresBackplane) listen(messages chan<- []byte) error {
+	conn, err := b.db.Acquire(b.ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(b.ctx, "LISTEN "+pgx.Identifier{backplaneChannel}.Sanitize()); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(b.ctx)
+		if err != nil {
+			return err
+		}
+
+		message, err := b.payload(notification.Payload)
+		if err != nil {
+			log.Printf("Unable to load backplane message: %v", err)
+			continue
+		}
+
+		select {
+		case messages <- message:
+		case <-b.ctx.Done():
+			return b.ctx.Err()
+		}
+	}
+}
+
+// payload resolves a notification payload to the published message.
+func (b *postgresBackplane) payload(payload string) ([]byte, error) {
+	if !strings.HasPrefix(payload, storedPayloadPrefix) {
+		return []byte(payload), nil
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(payload, storedPayloadPrefix), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	var message string
+	err = b.db.QueryRow(b.ctx, `SELECT payload FROM backplane_event WHERE id = $1`, id).Scan(&message)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(message), nil
+}
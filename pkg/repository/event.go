@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"chatService/pkg/api"
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Maximum number of events replayed per conversation when a client reconnects.
+// Clients that fell further behind reload the conversation through the REST API.
+const maxReplayEvents = 100
+
+// eventDoc is an entry of the event log of a conversation. The payload holds the
+// event as it was sent to the participants.
+type eventDoc struct {
+	Type      string    `firestore:"type"`
+	Sequence  int64     `firestore:"sequence"`
+	Payload   string    `firestore:"payload"`
+	CreatedAt time.Time `firestore:"createdAt"`
+
+	// Users removed by the event, so they can find it once they left the conversation
+	RemovedParticipants []string `firestore:"removedParticipants,omitempty"`
+}
+
+// eventRef returns the document of an event in the event log of a conversation.
+func eventRef(conversationRef *firestore.DocumentRef, sequence int64) *firestore.DocumentRef {
+	return conversationRef.Collection("events").Doc(strconv.FormatInt(sequence, 10))
+}
+
+// appendEvent writes an event to the event log of its conversation in the same
+// transaction as the change it describes. The event gets the next sequence of the
+// conversation, which must have been read in the transaction. Updates of the
+// conversation document are written together with its new sequence.
+func appendEvent(tx *firestore.Transaction, conversationRef *firestore.DocumentRef, conversation api.ConversationDoc, outgoingEvent *api.OutgoingEvent, updates ...firestore.Update) error {
+	outgoingEvent.Sequence = conversation.Sequence + 1
+
+	updates = append(updates, firestore.Update{
+		Path:  "sequence",
+		Value: outgoingEvent.Sequence,
+	})
+	if err := tx.Update(conversationRef, updates); err != nil {
+		return err
+	}
+
+	eventData, err := newEventData(*outgoingEvent)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(eventRef(conversationRef, outgoingEvent.Sequence), eventData)
+}
+
+// newEventData returns the fields of a new event document.
+func newEventData(outgoingEvent api.OutgoingEvent) (map[string]interface{}, error) {
+	payload, err := json.Marshal(outgoingEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	eventData := map[string]interface{}{
+		"type":      outgoingEvent.Type,
+		"sequence":  outgoingEvent.Sequence,
+		"payload":   string(payload),
+		"createdAt": firestore.ServerTimestamp,
+	}
+	if len(outgoingEvent.RemovedParticipants) > 0 {
+		eventData["removedParticipants"] = outgoingEvent.RemovedParticipants
+	}
+
+	return eventData, nil
+}
+
+// stampEvent sets the commit time of the transaction that wrote an event on the
+// message fields written as server timestamps, which all resolve to that time.
+func stampEvent(outgoingEvent *api.OutgoingEvent, committedAt time.Time) {
+	message := outgoingEvent.Message
+	if message == nil {
+		return
+	}
+
+	switch outgoingEvent.Type {
+	case api.AddMessage:
+		message.CreatedAt = committedAt
+	case api.EditMessage:
+		message.EditedAt = &committedAt
+	case api.RemoveMessage:
+		message.DeletedAt = &committedAt
+	}
+}
+
+// stampCommittedEvent reads back an event written by a transaction to stamp it
+// with the commit time.
+func stampCommittedEvent(ctx context.Context, conversationRef *firestore.DocumentRef, outgoingEvent *api.OutgoingEvent) error {
+	eventSnap, err := eventRef(conversationRef, outgoingEvent.Sequence).Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	stampEvent(outgoingEvent, eventSnap.CreateTime)
+	return nil
+}
+
+// eventFromSnap restores an event of the event log stamped with its commit time.
+func eventFromSnap(eventSnap *firestore.DocumentSnapshot) (api.OutgoingEvent, error) {
+	var event eventDoc
+	if err := eventSnap.DataTo(&event); err != nil {
+		return api.OutgoingEvent{}, err
+	}
+
+	outgoingEvent, err := decodeEvent(event.Type, []byte(event.Payload))
+	if err != nil {
+		return outgoingEvent, err
+	}
+	stampEvent(&outgoingEvent, event.CreatedAt)
+
+	return outgoingEvent, nil
+}
+
+// decodeEvent restores an event from its type and the payload stored in the event log.
+func decodeEvent(eventType string, payload []byte) (api.OutgoingEvent, error) {
+	var outgoingEvent api.OutgoingEvent
+	if err := json.Unmarshal(payload, &outgoingEvent); err != nil {
+		return outgoingEvent, err
+	}
+	outgoingEvent.Type = eventType
+
+	return outgoingEvent, nil
+}
+
+// removedUser reports whether an event removed the user from its conversation.
+func removedUser(outgoingEvent api.OutgoingEvent, userId string) bool {
+	if outgoingEvent.Type != api.RemoveParticipant {
+		return false
+	}
+
+	for _, id := range outgoingEvent.RemovedParticipants {
+		if id == userId {
+			return true
+		}
+	}
+	return false
+}
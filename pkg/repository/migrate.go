@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"embed"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io/fs"
+	"log"
+	"strings"
+)
+
+// Key of the advisory lock held while migrating, so instances starting at the
+// same time apply migrations one after another.
+const migrationLock = 7310641
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Migrate applies the embedded migrations that were not applied yet, in file name
+// order. Each migration is recorded in the schema_migration table.
+func Migrate(ctx context.Context, db *pgxpool.Pool) error {
+	entries, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+
+	return db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLock); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migration (
+			version    TEXT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			version := strings.TrimSuffix(entry.Name(), ".sql")
+
+			var applied bool
+			err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migration WHERE version = $1)", version).Scan(&applied)
+			if err != nil {
+				return err
+			}
+			if applied {
+				continue
+			}
+
+			migration, err := migrations.ReadFile("migrations/" + entry.Name())
+			if err != nil {
+				return err
+			}
+
+			// Without arguments the statements of a file are sent in a single query
+			if _, err := tx.Exec(ctx, string(migration)); err != nil {
+				log.Printf("Unable to apply migration %s: %v", version, err)
+				return err
+			}
+
+			if _, err := tx.Exec(ctx, "INSERT INTO schema_migration (version) VALUES ($1)", version); err != nil {
+				return err
+			}
+			log.Printf("Applied migration %s", version)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,112 @@
+-- gen_random_uuid() is built in from Postgres 13, older versions get it from pgcrypto
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_proc WHERE proname = 'gen_random_uuid') THEN
+        CREATE EXTENSION IF NOT EXISTS pgcrypto;
+    END IF;
+END
+$$;
+
+-- The creator may remove other participants. One-to-one conversations have a key
+-- made of their sorted participants, so only one exists per pair of users
+CREATE TABLE conversations (
+    id         TEXT PRIMARY KEY DEFAULT gen_random_uuid()::text,
+    type       TEXT        NOT NULL,
+    sequence   BIGINT      NOT NULL DEFAULT 0,
+    created_by TEXT        NOT NULL,
+    direct_key TEXT UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE participants (
+    conversation_id TEXT        NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    user_id         TEXT        NOT NULL,
+    joined_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX participants_user_id_idx ON participants (user_id);
+
+-- Replies reference their parent message
+CREATE TABLE messages (
+    id                TEXT PRIMARY KEY DEFAULT gen_random_uuid()::text,
+    conversation_id   TEXT        NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    parent_message_id TEXT REFERENCES messages (id) ON DELETE CASCADE,
+    sender_id         TEXT        NOT NULL,
+    content_type      TEXT        NOT NULL DEFAULT '',
+    body              TEXT        NOT NULL DEFAULT '',
+    attachments       TEXT[],
+    sequence          BIGINT,
+    client_key        TEXT,
+    reply_count       INTEGER     NOT NULL DEFAULT 0,
+    last_reply_at     TIMESTAMPTZ,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    edited_at         TIMESTAMPTZ,
+    deleted_at        TIMESTAMPTZ,
+    deleted_by        TEXT,
+    UNIQUE (conversation_id, sequence)
+);
+
+CREATE INDEX messages_conversation_id_created_at_idx ON messages (conversation_id, created_at) WHERE parent_message_id IS NULL;
+CREATE INDEX messages_parent_message_id_created_at_idx ON messages (parent_message_id, created_at) WHERE parent_message_id IS NOT NULL;
+CREATE UNIQUE INDEX messages_client_key_idx ON messages (conversation_id, sender_id, client_key) WHERE client_key IS NOT NULL;
+
+-- Previous versions of edited messages
+CREATE TABLE message_edits (
+    id          BIGSERIAL PRIMARY KEY,
+    message_id  TEXT        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    body        TEXT        NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    replaced_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX message_edits_message_id_idx ON message_edits (message_id);
+
+CREATE TABLE reactions (
+    message_id TEXT        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    reaction   TEXT        NOT NULL,
+    user_id    TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, reaction, user_id)
+);
+
+-- Conversation list and read cursor of each participant
+CREATE TABLE user_conversations (
+    user_id              TEXT        NOT NULL,
+    conversation_id      TEXT        NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    unread_count         INTEGER     NOT NULL DEFAULT 0,
+    last_read_message_id TEXT,
+    last_read_at         TIMESTAMPTZ,
+    last_updated         TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, conversation_id)
+);
+
+CREATE INDEX user_conversations_user_id_last_updated_idx ON user_conversations (user_id, last_updated DESC);
+
+-- Unread replies of the threads a user follows
+CREATE TABLE user_threads (
+    user_id      TEXT        NOT NULL,
+    message_id   TEXT        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    unread_count INTEGER     NOT NULL DEFAULT 0,
+    last_read_at TIMESTAMPTZ,
+    last_updated TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, message_id)
+);
+
+-- Event log of each conversation, replayed to clients catching up after reconnecting.
+-- Events take their sequence from the conversation, like the messages they add
+CREATE TABLE conversation_events (
+    conversation_id TEXT        NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    sequence        BIGINT      NOT NULL,
+    type            TEXT        NOT NULL,
+    payload         JSONB       NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (conversation_id, sequence)
+);
+
+-- Event streams resume from a point in time
+CREATE INDEX conversation_events_created_at_idx ON conversation_events (conversation_id, created_at);
+
+-- Users removed from a conversation look up the events that removed them
+CREATE INDEX conversation_events_removed_idx ON conversation_events USING GIN ((payload -> 'removedParticipants'))
+    WHERE type = 'participant.remove';
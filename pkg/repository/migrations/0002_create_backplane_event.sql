@@ -0,0 +1,9 @@
+-- Backplane messages too large for a notification payload. Rows are deleted once
+-- they are older than the retention of the backplane
+CREATE TABLE backplane_event (
+    id         BIGSERIAL PRIMARY KEY,
+    payload    TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX backplane_event_created_at_idx ON backplane_event (created_at);
@@ -0,0 +1,12 @@
+-- Status of the connections each instance holds for a user. Instances extend the
+-- expiry of their rows while running, rows of stopped instances expire
+CREATE TABLE presence_connections (
+    user_id    TEXT        NOT NULL,
+    instance   TEXT        NOT NULL,
+    status     TEXT        NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, instance)
+);
+
+CREATE INDEX presence_connections_instance_idx ON presence_connections (instance);
+CREATE INDEX presence_connections_expires_at_idx ON presence_connections (expires_at);
@@ -0,0 +1,1124 @@
+package repository
+
+import (
+	"chatService/pkg/api"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"sort"
+	"time"
+)
+
+// Number of recent messages loaded with a conversation.
+const conversationPageSize = 20
+
+// Columns of the messages table, in the order of messageRow.
+const messageColumns = "id, conversation_id, parent_message_id, sender_id, content_type, body, attachments, sequence, client_key, reply_count, last_reply_at, created_at, edited_at, deleted_at, deleted_by"
+
+// Columns of the user_conversations table, in the order of userConversationRow.
+const userConversationColumns = "user_id, conversation_id, unread_count, last_read_message_id, last_read_at, last_updated"
+
+// postgresStorage keeps conversations and messages in Postgres next to the
+// user_account table, with the same semantics as the Firestore storage.
+type postgresStorage struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresStorage(db *pgxpool.Pool) api.ChatRepository {
+	return &postgresStorage{db: db}
+}
+
+// querier runs queries on the pool or inside a transaction.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+type messageRow struct {
+	Id              string
+	ConversationId  string
+	ParentMessageId *string
+	SenderId        string
+	ContentType     string
+	Body            string
+	Attachments     []string
+	Sequence        *int64
+	ClientKey       *string
+	ReplyCount      int
+	LastReplyAt     *time.Time
+	CreatedAt       time.Time
+	EditedAt        *time.Time
+	DeletedAt       *time.Time
+	DeletedBy       *string
+}
+
+func (m messageRow) toMessage() api.Message {
+	message := api.Message{
+		Id:          m.Id,
+		SenderId:    m.SenderId,
+		ContentType: m.ContentType,
+		Body:        m.Body,
+		CreatedAt:   m.CreatedAt,
+		Attachments: m.Attachments,
+		EditedAt:    m.EditedAt,
+		DeletedAt:   m.DeletedAt,
+		ReplyCount:  m.ReplyCount,
+		LastReplyAt: m.LastReplyAt,
+	}
+	if m.ParentMessageId != nil {
+		message.ParentMessageId = *m.ParentMessageId
+	}
+	if m.Sequence != nil {
+		message.Sequence = *m.Sequence
+	}
+	if m.ClientKey != nil {
+		message.ClientKey = *m.ClientKey
+	}
+	if m.DeletedBy != nil {
+		message.DeletedBy = *m.DeletedBy
+	}
+
+	return message
+}
+
+type userConversationRow struct {
+	UserId            string
+	ConversationId    string
+	UnreadCount       int
+	LastReadMessageId *string
+	LastReadAt        *time.Time
+	LastUpdated       time.Time
+}
+
+// nullString stores empty strings as NULL.
+func nullString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// getParticipants returns the participants of a conversation in the order they joined.
+func getParticipants(ctx context.Context, q querier, conversationId string) ([]string, error) {
+	var participants []string
+	err := pgxscan.Select(ctx, q, &participants, "SELECT user_id FROM participants WHERE conversation_id = $1 ORDER BY joined_at, user_id", conversationId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Conversations everyone left still exist
+	if len(participants) == 0 {
+		var exists bool
+		err = q.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM conversations WHERE id = $1)", conversationId).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, api.ErrConversationNotFound
+		}
+	}
+
+	return participants, nil
+}
+
+// getMessage returns a message of a conversation, locking it when lock is set.
+// Replies are only found together with the id of their parent message.
+func getMessage(ctx context.Context, q querier, conversationId string, message *api.Message, lock bool) (messageRow, error) {
+	query := "SELECT " + messageColumns + " FROM messages WHERE id = $1 AND conversation_id = $2 AND parent_message_id IS NOT DISTINCT FROM $3"
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	var row messageRow
+	err := pgxscan.Get(ctx, q, &row, query, message.Id, conversationId, nullString(message.ParentMessageId))
+	if pgxscan.NotFound(err) {
+		log.Printf("Unable to find message with id %s", message.Id)
+		return row, api.ErrMessageNotFound
+	}
+
+	return row, err
+}
+
+// getUserConversation returns the conversation list entry of a participant.
+func getUserConversation(ctx context.Context, q querier, userId string, conversationId string) (userConversationRow, error) {
+	var row userConversationRow
+	err := pgxscan.Get(ctx, q, &row, "SELECT "+userConversationColumns+" FROM user_conversations WHERE user_id = $1 AND conversation_id = $2", userId, conversationId)
+	if pgxscan.NotFound(err) {
+		return row, api.ErrNotParticipant
+	}
+
+	return row, err
+}
+
+// nextSequence hands out the next sequence number of a conversation, locking the
+// conversation until the transaction ends so events are logged in order.
+func nextSequence(ctx context.Context, tx pgx.Tx, conversationId string) (int64, error) {
+	var sequence int64
+	err := tx.QueryRow(ctx, "UPDATE conversations SET sequence = sequence + 1 WHERE id = $1 RETURNING sequence", conversationId).Scan(&sequence)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, api.ErrConversationNotFound
+	}
+
+	return sequence, err
+}
+
+// appendEventRow writes an event to the event log of its conversation in the same
+// transaction as the change it describes, with the next sequence of the conversation.
+func appendEventRow(ctx context.Context, tx pgx.Tx, outgoingEvent *api.OutgoingEvent) error {
+	sequence, err := nextSequence(ctx, tx, outgoingEvent.ConversationId)
+	if err != nil {
+		return err
+	}
+	outgoingEvent.Sequence = sequence
+
+	return insertEventRow(ctx, tx, *outgoingEvent)
+}
+
+// insertEventRow writes an event whose sequence was already handed out.
+func insertEventRow(ctx context.Context, tx pgx.Tx, outgoingEvent api.OutgoingEvent) error {
+	payload, err := json.Marshal(outgoingEvent)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "INSERT INTO conversation_events (conversation_id, sequence, type, payload) VALUES ($1, $2, $3, $4)",
+		outgoingEvent.ConversationId, outgoingEvent.Sequence, outgoingEvent.Type, payload)
+	return err
+}
+
+// toMessages converts message rows and attaches their reactions.
+func toMessages(ctx context.Context, q querier, rows []messageRow) ([]api.Message, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	messageIds := make([]string, len(rows))
+	for i, row := range rows {
+		messageIds[i] = row.Id
+	}
+
+	reactions, err := getReactions(ctx, q, messageIds)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]api.Message, len(rows))
+	for i, row := range rows {
+		messages[i] = row.toMessage()
+		messages[i].Reactions = reactions[row.Id]
+	}
+
+	return messages, nil
+}
+
+// getReactions returns the reactions of messages keyed by message id.
+func getReactions(ctx context.Context, q querier, messageIds []string) (map[string]map[string]api.Reaction, error) {
+	rows, err := q.Query(ctx, "SELECT message_id, reaction, user_id FROM reactions WHERE message_id = ANY($1) ORDER BY created_at, user_id", messageIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[string]map[string]api.Reaction)
+	for rows.Next() {
+		var messageId, reaction, userId string
+		if err := rows.Scan(&messageId, &reaction, &userId); err != nil {
+			return nil, err
+		}
+
+		if reactions[messageId] == nil {
+			reactions[messageId] = make(map[string]api.Reaction)
+		}
+		r := reactions[messageId][reaction]
+		r.UserIds = append(r.UserIds, userId)
+		r.Count = len(r.UserIds)
+		reactions[messageId][reaction] = r
+	}
+
+	return reactions, rows.Err()
+}
+
+func (s *postgresStorage) AddMessage(incomingEvent api.IncomingEvent) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	messageData := incomingEvent.Message
+
+	// Replies are added to the thread of their parent message
+	if messageData.ParentMessageId != "" {
+		return s.addReply(incomingEvent)
+	}
+
+	var row messageRow
+	var participants []string
+	var duplicate bool
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// Locking the conversation hands out sequence numbers in order
+		var sequence int64
+		err := tx.QueryRow(ctx, "SELECT sequence FROM conversations WHERE id = $1 FOR UPDATE", incomingEvent.ConversationId).Scan(&sequence)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return api.ErrConversationNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if participants, err = getParticipants(ctx, tx, incomingEvent.ConversationId); err != nil {
+			return err
+		}
+
+		// A retry of a message that was already stored returns the stored message
+		if messageData.ClientKey != "" {
+			err = pgxscan.Get(ctx, tx, &row, "SELECT "+messageColumns+" FROM messages WHERE conversation_id = $1 AND sender_id = $2 AND client_key = $3",
+				incomingEvent.ConversationId, messageData.SenderId, messageData.ClientKey)
+			if err == nil {
+				duplicate = true
+				return nil
+			} else if !pgxscan.NotFound(err) {
+				return err
+			}
+		}
+		sequence++
+
+		if _, err = tx.Exec(ctx, "UPDATE conversations SET sequence = $2 WHERE id = $1", incomingEvent.ConversationId, sequence); err != nil {
+			return err
+		}
+
+		err = pgxscan.Get(ctx, tx, &row, `INSERT INTO messages (conversation_id, sender_id, content_type, body, sequence, client_key, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, clock_timestamp()) RETURNING `+messageColumns,
+			incomingEvent.ConversationId, messageData.SenderId, messageData.ContentType, messageData.Body, sequence, nullString(messageData.ClientKey))
+		if err != nil {
+			return err
+		}
+
+		// Update each participant's user conversation
+		_, err = tx.Exec(ctx, `UPDATE user_conversations
+			SET unread_count = unread_count + CASE WHEN user_id = $2 THEN 0 ELSE 1 END, last_updated = $3
+			WHERE conversation_id = $1 AND user_id = ANY($4)`,
+			incomingEvent.ConversationId, messageData.SenderId, row.CreatedAt, participants)
+		if err != nil {
+			return err
+		}
+
+		// New messages have no reactions yet
+		message := row.toMessage()
+		outgoingEvent = api.OutgoingEvent{
+			Message:        &message,
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   participants,
+			Sequence:       sequence,
+		}
+
+		return insertEventRow(ctx, tx, outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to add message: %v", err)
+		return outgoingEvent, err
+	}
+
+	if duplicate {
+		messages, err := toMessages(ctx, s.db, []messageRow{row})
+		if err != nil {
+			return outgoingEvent, err
+		}
+		log.Printf("Skipped duplicate message with client key %s", messageData.ClientKey)
+
+		return api.OutgoingEvent{
+			Message:        &messages[0],
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   participants,
+			Duplicate:      true,
+		}, nil
+	}
+	log.Printf("Created message with id: %s\n", row.Id)
+
+	return outgoingEvent, nil
+}
+
+func (s *postgresStorage) AddParticipant(incomingEvent api.IncomingEvent) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var id string
+		err := tx.QueryRow(ctx, "SELECT id FROM conversations WHERE id = $1 FOR UPDATE", incomingEvent.ConversationId).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("Unable to find conversation with id %s", incomingEvent.ConversationId)
+			return api.ErrConversationNotFound
+		} else if err != nil {
+			return err
+		}
+
+		participants, err := getParticipants(ctx, tx, incomingEvent.ConversationId)
+		if err != nil {
+			return err
+		}
+
+		isParticipant := make(map[string]bool, len(participants))
+		for _, id := range participants {
+			isParticipant[id] = true
+		}
+
+		// Participants that are not part of the conversation yet, without duplicates
+		var addedParticipants []string
+		for _, id := range incomingEvent.Participants {
+			if !isParticipant[id] {
+				isParticipant[id] = true
+				addedParticipants = append(addedParticipants, id)
+			}
+		}
+		sort.Strings(addedParticipants)
+
+		// Add the conversation to each new participant's conversation list
+		for _, id := range addedParticipants {
+			if _, err = tx.Exec(ctx, "INSERT INTO participants (conversation_id, user_id) VALUES ($1, $2)", incomingEvent.ConversationId, id); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(ctx, "INSERT INTO user_conversations (user_id, conversation_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", id, incomingEvent.ConversationId); err != nil {
+				return err
+			}
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			ConversationId:    incomingEvent.ConversationId,
+			Type:              incomingEvent.Type,
+			Participants:      participants,
+			AddedParticipants: addedParticipants,
+		}
+
+		return appendEventRow(ctx, tx, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to update participants: %v", err)
+		return outgoingEvent, err
+	}
+
+	log.Printf("Added new participants to conversation: %s\n", incomingEvent.ConversationId)
+
+	return outgoingEvent, nil
+}
+
+func (s *postgresStorage) RemoveParticipant(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	// Without a participant list the user is leaving the conversation
+	participantsToRemove := incomingEvent.Participants
+	if len(participantsToRemove) == 0 {
+		participantsToRemove = []string{userId}
+	}
+
+	removeSet := make(map[string]bool, len(participantsToRemove))
+	for _, id := range participantsToRemove {
+		removeSet[id] = true
+	}
+
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var conversationType string
+		var createdBy string
+		err := tx.QueryRow(ctx, "SELECT type, created_by FROM conversations WHERE id = $1 FOR UPDATE", incomingEvent.ConversationId).Scan(&conversationType, &createdBy)
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("Unable to find conversation with id %s", incomingEvent.ConversationId)
+			return api.ErrConversationNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if err = checkRemoval(conversationType, createdBy, userId, participantsToRemove); err != nil {
+			return err
+		}
+
+		participants, err := getParticipants(ctx, tx, incomingEvent.ConversationId)
+		if err != nil {
+			return err
+		}
+
+		var removedParticipants []string
+		for _, id := range participants {
+			if removeSet[id] {
+				removedParticipants = append(removedParticipants, id)
+			}
+		}
+
+		if len(removedParticipants) == 0 {
+			return api.ErrNotParticipant
+		}
+
+		// Remove the conversation from each removed user's conversation list
+		if _, err = tx.Exec(ctx, "DELETE FROM participants WHERE conversation_id = $1 AND user_id = ANY($2)", incomingEvent.ConversationId, removedParticipants); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM user_conversations WHERE conversation_id = $1 AND user_id = ANY($2)", incomingEvent.ConversationId, removedParticipants); err != nil {
+			return err
+		}
+
+		// Notify previous participants so removed users are also told about the change
+		outgoingEvent = api.OutgoingEvent{
+			ConversationId:      incomingEvent.ConversationId,
+			Type:                incomingEvent.Type,
+			Participants:        participants,
+			RemovedParticipants: removedParticipants,
+		}
+
+		return appendEventRow(ctx, tx, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to update participants: %v", err)
+		return outgoingEvent, err
+	}
+
+	log.Printf("Removed participants from conversation: %s\n", incomingEvent.ConversationId)
+
+	return outgoingEvent, nil
+}
+
+func (s *postgresStorage) RemoveMessage(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	if incomingEvent.Message == nil || incomingEvent.Message.Id == "" {
+		return outgoingEvent, api.ErrMessageNotFound
+	}
+
+	var row messageRow
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		if row, err = getMessage(ctx, tx, incomingEvent.ConversationId, incomingEvent.Message, true); err != nil {
+			return err
+		}
+
+		// Messages that were already removed are treated as missing
+		if row.DeletedAt != nil {
+			return api.ErrMessageNotFound
+		}
+
+		// Only the sender of a message is allowed to remove it
+		if row.SenderId != userId {
+			return api.ErrNotMessageSender
+		}
+
+		// Replace the message content with a tombstone so it keeps its place in the conversation
+		var deletedAt time.Time
+		err = tx.QueryRow(ctx, "UPDATE messages SET body = '', attachments = NULL, deleted_at = clock_timestamp(), deleted_by = $2 WHERE id = $1 RETURNING deleted_at",
+			row.Id, userId).Scan(&deletedAt)
+		if err != nil {
+			return err
+		}
+
+		// Previous versions of the message are removed along with its content
+		if _, err = tx.Exec(ctx, "DELETE FROM message_edits WHERE message_id = $1", row.Id); err != nil {
+			return err
+		}
+
+		participants, err := getParticipants(ctx, tx, incomingEvent.ConversationId)
+		if err != nil {
+			return err
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			Message: &api.Message{
+				Id:              row.Id,
+				SenderId:        row.SenderId,
+				ContentType:     row.ContentType,
+				CreatedAt:       row.CreatedAt,
+				DeletedAt:       &deletedAt,
+				DeletedBy:       userId,
+				ParentMessageId: incomingEvent.Message.ParentMessageId,
+			},
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   participants,
+		}
+
+		return appendEventRow(ctx, tx, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to remove message: %v", err)
+		return outgoingEvent, err
+	}
+	log.Printf("Removed message with id: %s\n", row.Id)
+
+	return outgoingEvent, nil
+}
+
+func (s *postgresStorage) EditMessage(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	if incomingEvent.Message == nil || incomingEvent.Message.Id == "" {
+		return outgoingEvent, api.ErrMessageNotFound
+	}
+
+	var row messageRow
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		if row, err = getMessage(ctx, tx, incomingEvent.ConversationId, incomingEvent.Message, true); err != nil {
+			return err
+		}
+
+		// Removed messages can no longer be edited
+		if row.DeletedAt != nil {
+			return api.ErrMessageNotFound
+		}
+
+		// Only the sender of a message is allowed to edit it
+		if row.SenderId != userId {
+			return api.ErrNotMessageSender
+		}
+
+		// The previous version was written either when the message was created or last edited
+		versionCreatedAt := row.CreatedAt
+		if row.EditedAt != nil {
+			versionCreatedAt = *row.EditedAt
+		}
+
+		// Save the previous version and update the message
+		_, err = tx.Exec(ctx, "INSERT INTO message_edits (message_id, body, created_at, replaced_at) VALUES ($1, $2, $3, clock_timestamp())",
+			row.Id, row.Body, versionCreatedAt)
+		if err != nil {
+			return err
+		}
+
+		var editedAt time.Time
+		err = tx.QueryRow(ctx, "UPDATE messages SET body = $2, edited_at = clock_timestamp() WHERE id = $1 RETURNING edited_at",
+			row.Id, incomingEvent.Message.Body).Scan(&editedAt)
+		if err != nil {
+			return err
+		}
+
+		participants, err := getParticipants(ctx, tx, incomingEvent.ConversationId)
+		if err != nil {
+			return err
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			Message: &api.Message{
+				Id:              row.Id,
+				SenderId:        row.SenderId,
+				ContentType:     row.ContentType,
+				Body:            incomingEvent.Message.Body,
+				CreatedAt:       row.CreatedAt,
+				Attachments:     row.Attachments,
+				EditedAt:        &editedAt,
+				ParentMessageId: incomingEvent.Message.ParentMessageId,
+			},
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   participants,
+		}
+
+		return appendEventRow(ctx, tx, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to edit message: %v", err)
+		return outgoingEvent, err
+	}
+	log.Printf("Edited message with id: %s\n", row.Id)
+
+	return outgoingEvent, nil
+}
+
+func (s *postgresStorage) GetParticipants(conversationId string) ([]string, error) {
+	return getParticipants(context.Background(), s.db, conversationId)
+}
+
+func (s *postgresStorage) MarkConversationAsRead(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		userConversation, err := getUserConversation(ctx, tx, userId, incomingEvent.ConversationId)
+		if err != nil {
+			return err
+		}
+
+		// Find the message the user has read up to, defaulting to the latest message
+		var message messageRow
+		if incomingEvent.Message != nil && incomingEvent.Message.Id != "" {
+			err = pgxscan.Get(ctx, tx, &message, "SELECT "+messageColumns+" FROM messages WHERE id = $1 AND conversation_id = $2 AND parent_message_id IS NULL",
+				incomingEvent.Message.Id, incomingEvent.ConversationId)
+		} else {
+			err = pgxscan.Get(ctx, tx, &message, "SELECT "+messageColumns+" FROM messages WHERE conversation_id = $1 AND parent_message_id IS NULL ORDER BY created_at DESC LIMIT 1",
+				incomingEvent.ConversationId)
+		}
+		if pgxscan.NotFound(err) {
+			return api.ErrMessageNotFound
+		} else if err != nil {
+			return err
+		}
+
+		readReceipt := api.ReadReceipt{
+			UserId:            userId,
+			LastReadMessageId: message.Id,
+			LastReadAt:        &message.CreatedAt,
+		}
+
+		// Never move the read cursor backwards
+		if userConversation.LastReadAt != nil && !userConversation.LastReadAt.Before(message.CreatedAt) {
+			if userConversation.LastReadMessageId != nil {
+				readReceipt.LastReadMessageId = *userConversation.LastReadMessageId
+			}
+			readReceipt.LastReadAt = userConversation.LastReadAt
+		}
+
+		// Recompute the unread count from the messages after the read cursor
+		var unreadCount int
+		err = tx.QueryRow(ctx, `SELECT count(*) FROM messages
+			WHERE conversation_id = $1 AND parent_message_id IS NULL AND created_at > $2 AND sender_id <> $3 AND deleted_at IS NULL`,
+			incomingEvent.ConversationId, *readReceipt.LastReadAt, userId).Scan(&unreadCount)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, "UPDATE user_conversations SET last_read_message_id = $3, last_read_at = $4, unread_count = $5 WHERE user_id = $1 AND conversation_id = $2",
+			userId, incomingEvent.ConversationId, readReceipt.LastReadMessageId, *readReceipt.LastReadAt, unreadCount)
+		if err != nil {
+			return err
+		}
+
+		participants, err := getParticipants(ctx, tx, incomingEvent.ConversationId)
+		if err != nil {
+			return err
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   participants,
+			UserId:         userId,
+			ReadReceipt:    &readReceipt,
+		}
+
+		return appendEventRow(ctx, tx, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to update read cursor of user conversation: %v", err)
+		return outgoingEvent, err
+	}
+
+	return outgoingEvent, nil
+}
+
+// getReadReceipts returns the read cursor of every participant in a conversation.
+func (s *postgresStorage) getReadReceipts(ctx context.Context, conversationId string, participants []string) ([]api.ReadReceipt, error) {
+	var userConversations []userConversationRow
+	err := pgxscan.Select(ctx, s.db, &userConversations, "SELECT "+userConversationColumns+" FROM user_conversations WHERE conversation_id = $1 AND user_id = ANY($2)",
+		conversationId, participants)
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[string]userConversationRow, len(userConversations))
+	for _, userConversation := range userConversations {
+		byUser[userConversation.UserId] = userConversation
+	}
+
+	var readReceipts []api.ReadReceipt
+	for _, id := range participants {
+		userConversation, ok := byUser[id]
+		if !ok {
+			continue
+		}
+
+		readReceipt := api.ReadReceipt{
+			UserId:     id,
+			LastReadAt: userConversation.LastReadAt,
+		}
+		if userConversation.LastReadMessageId != nil {
+			readReceipt.LastReadMessageId = *userConversation.LastReadMessageId
+		}
+		readReceipts = append(readReceipts, readReceipt)
+	}
+
+	return readReceipts, nil
+}
+
+func (s *postgresStorage) GetContactIds(userId string) ([]string, error) {
+	var contactIds []string
+	err := pgxscan.Select(context.Background(), s.db, &contactIds, `SELECT DISTINCT contact.user_id
+		FROM participants AS participant
+		JOIN participants AS contact ON contact.conversation_id = participant.conversation_id
+		WHERE participant.user_id = $1 AND contact.user_id <> $1`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return contactIds, nil
+}
+
+func (s *postgresStorage) AddReaction(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	return s.updateReaction(incomingEvent, userId, true)
+}
+
+func (s *postgresStorage) RemoveReaction(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	return s.updateReaction(incomingEvent, userId, false)
+}
+
+// updateReaction adds or removes the user from the reacting users of a message.
+func (s *postgresStorage) updateReaction(incomingEvent api.IncomingEvent, userId string, add bool) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	if incomingEvent.Message == nil || incomingEvent.Message.Id == "" {
+		return outgoingEvent, api.ErrMessageNotFound
+	}
+
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		row, err := getMessage(ctx, tx, incomingEvent.ConversationId, incomingEvent.Message, true)
+		if err != nil {
+			return err
+		}
+
+		// Removed messages can no longer receive reactions
+		if row.DeletedAt != nil {
+			return api.ErrMessageNotFound
+		}
+
+		// Nothing changes when the user already reacted or never reacted
+		if add {
+			_, err = tx.Exec(ctx, "INSERT INTO reactions (message_id, reaction, user_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+				row.Id, incomingEvent.Reaction, userId)
+		} else {
+			_, err = tx.Exec(ctx, "DELETE FROM reactions WHERE message_id = $1 AND reaction = $2 AND user_id = $3",
+				row.Id, incomingEvent.Reaction, userId)
+		}
+		if err != nil {
+			return err
+		}
+
+		messageReactions, err := getReactions(ctx, tx, []string{row.Id})
+		if err != nil {
+			return err
+		}
+
+		reactions := messageReactions[row.Id]
+		if reactions == nil {
+			reactions = make(map[string]api.Reaction)
+		}
+
+		participants, err := getParticipants(ctx, tx, incomingEvent.ConversationId)
+		if err != nil {
+			return err
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			Message: &api.Message{
+				Id:              row.Id,
+				Reactions:       reactions,
+				ParentMessageId: incomingEvent.Message.ParentMessageId,
+			},
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   participants,
+			UserId:         userId,
+			Reaction:       incomingEvent.Reaction,
+		}
+
+		return appendEventRow(ctx, tx, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to update reactions of message: %v", err)
+		return outgoingEvent, err
+	}
+
+	return outgoingEvent, nil
+}
+
+// eventRow is an entry of the event log of a conversation.
+type eventRow struct {
+	Sequence int64
+	Type     string
+	Payload  []byte
+}
+
+func (s *postgresStorage) GetMissedEvents(userId string, cursors map[string]int64) ([]api.OutgoingEvent, error) {
+	ctx := context.Background()
+
+	// Conversations the client has no cursor for are loaded through the REST API instead
+	conversationIds := make([]string, 0, len(cursors))
+	for conversationId := range cursors {
+		conversationIds = append(conversationIds, conversationId)
+	}
+	sort.Strings(conversationIds)
+
+	var participating []string
+	err := pgxscan.Select(ctx, s.db, &participating, "SELECT conversation_id FROM user_conversations WHERE user_id = $1 AND conversation_id = ANY($2)",
+		userId, conversationIds)
+	if err != nil {
+		return nil, err
+	}
+
+	isParticipant := make(map[string]bool, len(participating))
+	for _, conversationId := range participating {
+		isParticipant[conversationId] = true
+	}
+
+	var outgoingEvents []api.OutgoingEvent
+	for _, conversationId := range conversationIds {
+		// Query for events the client has not seen yet, oldest first. Users removed
+		// from a conversation only learn about their removal.
+		var rows []eventRow
+		if isParticipant[conversationId] {
+			err = pgxscan.Select(ctx, s.db, &rows, "SELECT sequence, type, payload FROM conversation_events WHERE conversation_id = $1 AND sequence > $2 ORDER BY sequence LIMIT $3",
+				conversationId, cursors[conversationId], maxReplayEvents)
+		} else {
+			err = pgxscan.Select(ctx, s.db, &rows, `SELECT sequence, type, payload FROM conversation_events
+				WHERE conversation_id = $1 AND sequence > $2 AND type = $3 AND payload->'removedParticipants' ? $4 ORDER BY sequence LIMIT 1`,
+				conversationId, cursors[conversationId], api.RemoveParticipant, userId)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			outgoingEvent, err := decodeEvent(row.Type, row.Payload)
+			if err != nil {
+				return nil, err
+			}
+			outgoingEvents = append(outgoingEvents, outgoingEvent)
+		}
+	}
+
+	return outgoingEvents, nil
+}
+
+func (s *postgresStorage) GetEventsSince(userId string, since time.Time) ([]api.OutgoingEvent, error) {
+	ctx := context.Background()
+
+	// Events of the user's conversations, oldest first
+	var rows []eventRow
+	err := pgxscan.Select(ctx, s.db, &rows, `SELECT e.sequence, e.type, e.payload FROM user_conversations uc
+		JOIN LATERAL (
+			SELECT conversation_id, sequence, type, payload FROM conversation_events
+			WHERE conversation_id = uc.conversation_id AND created_at > $2 ORDER BY sequence LIMIT $3
+		) e ON true
+		WHERE uc.user_id = $1 ORDER BY e.conversation_id, e.sequence`,
+		userId, since, maxReplayEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	// Users removed from a conversation meanwhile only learn about their removal
+	var removals []eventRow
+	err = pgxscan.Select(ctx, s.db, &removals, `SELECT DISTINCT ON (e.conversation_id) e.sequence, e.type, e.payload FROM conversation_events e
+		WHERE e.type = $3 AND e.payload->'removedParticipants' ? $1 AND e.created_at > $2
+			AND NOT EXISTS (SELECT 1 FROM user_conversations uc WHERE uc.conversation_id = e.conversation_id AND uc.user_id = $1)
+		ORDER BY e.conversation_id, e.sequence`,
+		userId, since, api.RemoveParticipant)
+	if err != nil {
+		return nil, err
+	}
+
+	var outgoingEvents []api.OutgoingEvent
+	for _, row := range append(rows, removals...) {
+		outgoingEvent, err := decodeEvent(row.Type, row.Payload)
+		if err != nil {
+			return nil, err
+		}
+		outgoingEvents = append(outgoingEvents, outgoingEvent)
+	}
+
+	return outgoingEvents, nil
+}
+
+func (s *postgresStorage) UpdateConversation() {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (s *postgresStorage) GetConversation(userId string, conversationId string) (api.Conversation, error) {
+	ctx := context.Background()
+
+	userConversation, err := getUserConversation(ctx, s.db, userId, conversationId)
+	if err != nil {
+		return api.Conversation{}, err
+	}
+
+	return s.conversation(ctx, userConversation)
+}
+
+func (s *postgresStorage) GetConversations(userId string) ([]api.Conversation, error) {
+	ctx := context.Background()
+
+	var userConversations []userConversationRow
+	err := pgxscan.Select(ctx, s.db, &userConversations, "SELECT "+userConversationColumns+" FROM user_conversations WHERE user_id = $1 ORDER BY last_updated DESC", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	var conversations []api.Conversation
+	for _, userConversation := range userConversations {
+		conversation, err := s.conversation(ctx, userConversation)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	return conversations, nil
+}
+
+// conversation loads a conversation as seen by the owner of a conversation list entry.
+func (s *postgresStorage) conversation(ctx context.Context, userConversation userConversationRow) (api.Conversation, error) {
+	var conversation api.Conversation
+
+	var conversationType string
+	err := s.db.QueryRow(ctx, "SELECT type FROM conversations WHERE id = $1", userConversation.ConversationId).Scan(&conversationType)
+	if err != nil {
+		return conversation, err
+	}
+
+	participants, err := s.GetParticipants(userConversation.ConversationId)
+	if err != nil {
+		return conversation, err
+	}
+
+	// Get the most recent messages, oldest first
+	var rows []messageRow
+	err = pgxscan.Select(ctx, s.db, &rows, `SELECT * FROM (
+			SELECT `+messageColumns+` FROM messages WHERE conversation_id = $1 AND parent_message_id IS NULL ORDER BY created_at DESC LIMIT $2
+		) AS recent ORDER BY created_at`,
+		userConversation.ConversationId, conversationPageSize)
+	if err != nil {
+		return conversation, err
+	}
+
+	messages, err := toMessages(ctx, s.db, rows)
+	if err != nil {
+		return conversation, err
+	}
+
+	// Get user details from db
+	users, err := getUserByIds(ctx, s.db, participants)
+	if err != nil {
+		log.Println(err)
+		return conversation, err
+	}
+
+	var usersDTO []api.User
+	for _, user := range users {
+		usersDTO = append(usersDTO, user.ConvertToDTO())
+	}
+
+	// Get how far each participant has read
+	readReceipts, err := s.getReadReceipts(ctx, userConversation.ConversationId, participants)
+	if err != nil {
+		return conversation, err
+	}
+
+	conversation = api.Conversation{
+		Id:           userConversation.ConversationId,
+		Participants: usersDTO,
+		Type:         conversationType,
+		Messages:     messages,
+		UnreadCount:  userConversation.UnreadCount,
+		ReadReceipts: readReceipts,
+	}
+
+	return conversation, nil
+}
+
+func (s *postgresStorage) CreateConversation(newConversation api.NewConversation, userId string) (api.Conversation, error) {
+	var conversation api.Conversation
+	ctx := context.Background()
+
+	// Retrieves users found in participants array from database
+	users, err := getUserByIds(ctx, s.db, newConversation.Participants)
+	if err != nil {
+		log.Printf("Retrieving users %v from database\n", err)
+		return conversation, err
+	}
+
+	// Check if all the users exist in the database
+	if len(users) == 0 || len(users) != len(newConversation.Participants) {
+		log.Println("One of the users was not found")
+		return conversation, api.ErrUserNotFound
+	}
+
+	var usersDTO []api.User
+	for _, user := range users {
+		usersDTO = append(usersDTO, user.ConvertToDTO())
+	}
+
+	conversationType := api.OneToOneConversation
+	if len(newConversation.Participants) > 2 {
+		conversationType = api.GroupConversation
+	}
+
+	var conversationId string
+	var message messageRow
+	err = s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// Only one one-to-one conversation exists per pair of users
+		err := tx.QueryRow(ctx, `INSERT INTO conversations (type, sequence, created_by, direct_key) VALUES ($1, 1, $2, NULLIF($3, ''))
+			ON CONFLICT (direct_key) DO NOTHING RETURNING id`,
+			conversationType, userId, directKey(conversationType, newConversation.Participants)).Scan(&conversationId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return api.ErrConversationExists
+		}
+		if err != nil {
+			return err
+		}
+
+		err = pgxscan.Get(ctx, tx, &message, `INSERT INTO messages (conversation_id, sender_id, content_type, body, sequence, created_at)
+			VALUES ($1, $2, $3, $4, 1, clock_timestamp()) RETURNING `+messageColumns,
+			conversationId, newConversation.Message.SenderId, newConversation.Message.ContentType, newConversation.Message.Body)
+		if err != nil {
+			return err
+		}
+
+		// The first message is also the first event of the conversation
+		firstMessage := message.toMessage()
+		err = insertEventRow(ctx, tx, api.OutgoingEvent{
+			Message:        &firstMessage,
+			ConversationId: conversationId,
+			Type:           api.AddMessage,
+			Participants:   newConversation.Participants,
+			Sequence:       1,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Create a user conversation for each participant
+		for _, id := range newConversation.Participants {
+			var unreadCount int
+			// Check if uid is the same as the conversation creator's uid
+			if id != userId {
+				unreadCount = 1
+			}
+
+			if _, err = tx.Exec(ctx, "INSERT INTO participants (conversation_id, user_id) VALUES ($1, $2)", conversationId, id); err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(ctx, "INSERT INTO user_conversations (user_id, conversation_id, unread_count, last_updated) VALUES ($1, $2, $3, $4)",
+				id, conversationId, unreadCount, message.CreatedAt)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("Unable to create conversation: %v", err)
+		return conversation, err
+	}
+	log.Printf("Created conversation with id: %s\n", conversationId)
+
+	// Construct conversation output
+	conversation = api.Conversation{
+		Id:           conversationId,
+		Participants: usersDTO,
+		Type:         conversationType,
+		Messages:     []api.Message{message.toMessage()},
+		UnreadCount:  0,
+	}
+
+	return conversation, nil
+}
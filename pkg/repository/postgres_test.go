@@ -0,0 +1,237 @@
+package repository
+
+import (
+	"chatService/pkg/api"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testDatabase connects to the database in TEST_DATABASE_URL and migrates a schema
+// created for the test, which is dropped once the test finished.
+func testDatabase(t *testing.T) *pgxpool.Pool {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatalf("Unable to parse TEST_DATABASE_URL: %v", err)
+	}
+	schema := "chat_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	config.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+
+	db, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		t.Fatalf("Unable to connect to test database: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Errorf("Unable to drop schema %s: %v", schema, err)
+		}
+		db.Close()
+	})
+
+	if _, err := db.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("Unable to create schema %s: %v", schema, err)
+	}
+
+	// The user_account table is managed outside of the migrations
+	_, err = db.Exec(ctx, `CREATE TABLE user_account (
+		uid           TEXT PRIMARY KEY,
+		first_name    TEXT,
+		last_name     TEXT,
+		username      TEXT        NOT NULL,
+		email         TEXT        NOT NULL,
+		address       TEXT,
+		city          TEXT,
+		state         TEXT,
+		country       TEXT,
+		zip_code      TEXT,
+		photo_url     TEXT,
+		phone_number  TEXT,
+		status        TEXT        NOT NULL DEFAULT 'OFFLINE',
+		last_activity TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		t.Fatalf("Unable to create user_account: %v", err)
+	}
+
+	if err := Migrate(ctx, db); err != nil {
+		t.Fatalf("Unable to migrate: %v", err)
+	}
+
+	return db
+}
+
+func createUsers(t *testing.T, db *pgxpool.Pool, ids ...string) {
+	for _, id := range ids {
+		_, err := db.Exec(context.Background(), "INSERT INTO user_account (uid, username, email) VALUES ($1, $1, $1 || '@example.com')", id)
+		if err != nil {
+			t.Fatalf("Unable to create user %s: %v", id, err)
+		}
+	}
+}
+
+func newTestConversation(participants ...string) api.NewConversation {
+	return api.NewConversation{
+		Participants: participants,
+		Message:      api.Message{SenderId: participants[0], ContentType: "text", Body: "hello"},
+	}
+}
+
+func TestMigrateTwice(t *testing.T) {
+	db := testDatabase(t)
+
+	if err := Migrate(context.Background(), db); err != nil {
+		t.Errorf("Migrate = %v, want no error", err)
+	}
+}
+
+func TestCreateConversationOneToOneOnce(t *testing.T) {
+	db := testDatabase(t)
+	createUsers(t, db, "alice", "bob", "carol")
+	storage := NewPostgresStorage(db)
+
+	conversation, err := storage.CreateConversation(newTestConversation("alice", "bob"), "alice")
+	if err != nil {
+		t.Fatalf("CreateConversation = %v", err)
+	}
+	if conversation.Type != api.OneToOneConversation {
+		t.Errorf("type = %s, want %s", conversation.Type, api.OneToOneConversation)
+	}
+
+	// The same pair in any order is the same conversation
+	if _, err := storage.CreateConversation(newTestConversation("bob", "alice"), "bob"); !errors.Is(err, api.ErrConversationExists) {
+		t.Errorf("CreateConversation = %v, want %v", err, api.ErrConversationExists)
+	}
+
+	if _, err := storage.CreateConversation(newTestConversation("alice", "carol"), "alice"); err != nil {
+		t.Errorf("CreateConversation with another user = %v", err)
+	}
+
+	// Groups with the same participants are allowed
+	for i := 0; i < 2; i++ {
+		if _, err := storage.CreateConversation(newTestConversation("alice", "bob", "carol"), "alice"); err != nil {
+			t.Errorf("CreateConversation of group = %v", err)
+		}
+	}
+}
+
+func TestCreateConversationUnknownUser(t *testing.T) {
+	db := testDatabase(t)
+	createUsers(t, db, "alice")
+	storage := NewPostgresStorage(db)
+
+	if _, err := storage.CreateConversation(newTestConversation("alice", "nobody"), "alice"); !errors.Is(err, api.ErrUserNotFound) {
+		t.Errorf("CreateConversation = %v, want %v", err, api.ErrUserNotFound)
+	}
+}
+
+func TestAddMessageAndGetMissedEvents(t *testing.T) {
+	db := testDatabase(t)
+	createUsers(t, db, "alice", "bob")
+	storage := NewPostgresStorage(db)
+
+	conversation, err := storage.CreateConversation(newTestConversation("alice", "bob"), "alice")
+	if err != nil {
+		t.Fatalf("CreateConversation = %v", err)
+	}
+
+	outgoingEvent, err := storage.AddMessage(api.IncomingEvent{
+		ConversationId: conversation.Id,
+		Type:           api.AddMessage,
+		Message:        &api.Message{SenderId: "bob", ContentType: "text", Body: "hi"},
+	})
+	if err != nil {
+		t.Fatalf("AddMessage = %v", err)
+	}
+	if outgoingEvent.Sequence != 2 {
+		t.Errorf("sequence = %d, want 2", outgoingEvent.Sequence)
+	}
+
+	// Alice has seen the first message only
+	events, err := storage.GetMissedEvents("alice", map[string]int64{conversation.Id: 1})
+	if err != nil {
+		t.Fatalf("GetMissedEvents = %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("missed events = %d, want 1", len(events))
+	}
+	if events[0].Type != api.AddMessage || events[0].Sequence != 2 || events[0].Message == nil || events[0].Message.Body != "hi" {
+		t.Errorf("missed event = %+v, want the message of bob", events[0])
+	}
+
+	conversation, err = storage.GetConversation("alice", conversation.Id)
+	if err != nil {
+		t.Fatalf("GetConversation = %v", err)
+	}
+	if conversation.UnreadCount != 1 {
+		t.Errorf("unread count = %d, want 1", conversation.UnreadCount)
+	}
+}
+
+func TestRemoveParticipantOfOneToOne(t *testing.T) {
+	db := testDatabase(t)
+	createUsers(t, db, "alice", "bob")
+	storage := NewPostgresStorage(db)
+
+	conversation, err := storage.CreateConversation(newTestConversation("alice", "bob"), "alice")
+	if err != nil {
+		t.Fatalf("CreateConversation = %v", err)
+	}
+
+	_, err = storage.RemoveParticipant(api.IncomingEvent{
+		ConversationId: conversation.Id,
+		Type:           api.RemoveParticipant,
+		Participants:   []string{"alice"},
+	}, "alice")
+	if !errors.Is(err, api.ErrOneToOneConversation) {
+		t.Errorf("RemoveParticipant = %v, want %v", err, api.ErrOneToOneConversation)
+	}
+}
+
+func TestInstancePresence(t *testing.T) {
+	db := testDatabase(t)
+	createUsers(t, db, "alice")
+	storage := NewStorage(db, nil)
+	expiresAt := time.Now().Add(time.Minute)
+
+	steps := []struct {
+		instance string
+		status   string
+		want     string
+		changed  bool
+	}{
+		{instance: "a", status: api.OnlineStatus, want: api.OnlineStatus, changed: true},
+		{instance: "b", status: api.AwayStatus, want: api.OnlineStatus, changed: false},
+		{instance: "a", status: api.OfflineStatus, want: api.AwayStatus, changed: true},
+		{instance: "b", status: api.OfflineStatus, want: api.OfflineStatus, changed: true},
+	}
+
+	for _, step := range steps {
+		lastActivity := time.Now().Truncate(time.Millisecond)
+		presence, changed, err := storage.UpdateInstancePresence(step.instance, api.UserPresence{UserId: "alice", Status: step.status, LastActivity: lastActivity}, expiresAt)
+		if err != nil {
+			t.Fatalf("UpdateInstancePresence = %v", err)
+		}
+		if presence.Status != step.want || changed != step.changed {
+			t.Errorf("instance %s %s: status, changed = %s, %v, want %s, %v", step.instance, step.status, presence.Status, changed, step.want, step.changed)
+		}
+
+		// The last activity is stored even when the status stays the same
+		var stored time.Time
+		if err := db.QueryRow(context.Background(), "SELECT last_activity FROM user_account WHERE uid = 'alice'").Scan(&stored); err != nil {
+			t.Fatalf("Unable to get last activity: %v", err)
+		}
+		if !stored.Equal(lastActivity) {
+			t.Errorf("instance %s %s: last activity = %v, want %v", step.instance, step.status, stored, lastActivity)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"chatService/pkg/api"
+	"context"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"time"
+)
+
+func (s *postgresStorage) addReply(incomingEvent api.IncomingEvent) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	messageData := incomingEvent.Message
+
+	var row messageRow
+	var participants []string
+	var duplicate bool
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// Locking the parent message keeps the thread summary consistent
+		root, err := getMessage(ctx, tx, incomingEvent.ConversationId, &api.Message{Id: messageData.ParentMessageId}, true)
+		if err != nil {
+			return err
+		}
+
+		// Removed messages can no longer be replied to
+		if root.DeletedAt != nil {
+			return api.ErrMessageNotFound
+		}
+
+		if participants, err = getParticipants(ctx, tx, incomingEvent.ConversationId); err != nil {
+			return err
+		}
+
+		// A retry of a reply that was already stored returns the stored reply
+		if messageData.ClientKey != "" {
+			err = pgxscan.Get(ctx, tx, &row, "SELECT "+messageColumns+" FROM messages WHERE conversation_id = $1 AND sender_id = $2 AND client_key = $3",
+				incomingEvent.ConversationId, messageData.SenderId, messageData.ClientKey)
+			if err == nil {
+				duplicate = true
+				return nil
+			} else if !pgxscan.NotFound(err) {
+				return err
+			}
+		}
+
+		// Users following the thread are the author of the root message and everyone who replied
+		var followers []string
+		err = pgxscan.Select(ctx, tx, &followers, "SELECT DISTINCT sender_id FROM messages WHERE parent_message_id = $1", root.Id)
+		if err != nil {
+			return err
+		}
+		followers = append([]string{root.SenderId}, followers...)
+
+		// Replies take the next sequence of the conversation like other messages
+		sequence, err := nextSequence(ctx, tx, incomingEvent.ConversationId)
+		if err != nil {
+			return err
+		}
+
+		err = pgxscan.Get(ctx, tx, &row, `INSERT INTO messages (conversation_id, parent_message_id, sender_id, content_type, body, sequence, client_key, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, clock_timestamp()) RETURNING `+messageColumns,
+			incomingEvent.ConversationId, root.Id, messageData.SenderId, messageData.ContentType, messageData.Body, sequence, nullString(messageData.ClientKey))
+		if err != nil {
+			return err
+		}
+
+		// Update the thread summary on the root message
+		_, err = tx.Exec(ctx, "UPDATE messages SET reply_count = reply_count + 1, last_reply_at = $2 WHERE id = $1", root.Id, row.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		isParticipant := make(map[string]bool, len(participants))
+		for _, id := range participants {
+			isParticipant[id] = true
+		}
+
+		notified := make(map[string]bool)
+		for _, id := range followers {
+			if id == messageData.SenderId || notified[id] || !isParticipant[id] {
+				continue
+			}
+			notified[id] = true
+
+			_, err = tx.Exec(ctx, `INSERT INTO user_threads (user_id, message_id, unread_count, last_updated) VALUES ($1, $2, 1, $3)
+				ON CONFLICT (user_id, message_id) DO UPDATE SET unread_count = user_threads.unread_count + 1, last_updated = excluded.last_updated`,
+				id, root.Id, row.CreatedAt)
+			if err != nil {
+				return err
+			}
+		}
+
+		// New replies have no reactions yet
+		message := row.toMessage()
+		outgoingEvent = api.OutgoingEvent{
+			Message:        &message,
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   participants,
+			Sequence:       sequence,
+		}
+
+		return insertEventRow(ctx, tx, outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to add reply: %v", err)
+		return outgoingEvent, err
+	}
+
+	if duplicate {
+		messages, err := toMessages(ctx, s.db, []messageRow{row})
+		if err != nil {
+			return outgoingEvent, err
+		}
+		log.Printf("Skipped duplicate reply with client key %s", messageData.ClientKey)
+
+		return api.OutgoingEvent{
+			Message:        &messages[0],
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   participants,
+			Duplicate:      true,
+		}, nil
+	}
+	log.Printf("Created reply with id: %s\n", row.Id)
+
+	return outgoingEvent, nil
+}
+
+func (s *postgresStorage) GetThread(userId string, conversationId string, messageId string, before time.Time, limit int) (api.Thread, error) {
+	ctx := context.Background()
+	var thread api.Thread
+
+	// Only participants of the conversation can read its threads
+	if _, err := getUserConversation(ctx, s.db, userId, conversationId); err != nil {
+		return thread, err
+	}
+
+	root, err := getMessage(ctx, s.db, conversationId, &api.Message{Id: messageId}, false)
+	if err != nil {
+		return thread, err
+	}
+
+	// Page backwards through the replies starting from the newest
+	var rows []messageRow
+	if before.IsZero() {
+		err = pgxscan.Select(ctx, s.db, &rows, "SELECT "+messageColumns+" FROM messages WHERE parent_message_id = $1 ORDER BY created_at DESC LIMIT $2",
+			root.Id, limit)
+	} else {
+		err = pgxscan.Select(ctx, s.db, &rows, "SELECT "+messageColumns+" FROM messages WHERE parent_message_id = $1 AND created_at < $3 ORDER BY created_at DESC LIMIT $2",
+			root.Id, limit, before)
+	}
+	if err != nil {
+		return thread, err
+	}
+
+	// Replies are returned oldest first, after the root message
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+
+	messages, err := toMessages(ctx, s.db, append([]messageRow{root}, rows...))
+	if err != nil {
+		return thread, err
+	}
+
+	// Get the user's unread state of the thread, which does not exist until someone replies
+	var userThread api.UserThread
+	err = s.db.QueryRow(ctx, "SELECT unread_count FROM user_threads WHERE user_id = $1 AND message_id = $2", userId, root.Id).Scan(&userThread.UnreadCount)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return thread, err
+	}
+
+	thread = api.Thread{
+		Root:        messages[0],
+		Replies:     append([]api.Message{}, messages[1:]...),
+		UnreadCount: userThread.UnreadCount,
+	}
+
+	return thread, nil
+}
+
+func (s *postgresStorage) MarkThreadAsRead(userId string, conversationId string, messageId string) error {
+	ctx := context.Background()
+
+	// Only participants of the conversation can read its threads
+	if _, err := getUserConversation(ctx, s.db, userId, conversationId); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(ctx, `INSERT INTO user_threads (user_id, message_id, unread_count, last_read_at)
+		SELECT $1::text, id, 0, now() FROM messages WHERE id = $2 AND conversation_id = $3 AND parent_message_id IS NULL
+		ON CONFLICT (user_id, message_id) DO UPDATE SET unread_count = 0, last_read_at = excluded.last_read_at`,
+		userId, messageId, conversationId)
+	if err != nil {
+		log.Printf("Unable to mark thread as read: %v", err)
+		return err
+	}
+
+	return nil
+}
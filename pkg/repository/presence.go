@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"chatService/pkg/api"
+	"context"
+	"errors"
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Precedence of statuses reported by several instances: a user is online while any
+// instance holds an active connection, and away while all connections are idle.
+var statusRanks = map[string]int{
+	api.OfflineStatus: 0,
+	api.AwayStatus:    1,
+	api.OnlineStatus:  2,
+}
+
+func (s *storage) UpdateInstancePresence(instance string, presence api.UserPresence, expiresAt time.Time) (api.UserPresence, bool, error) {
+	ctx := context.Background()
+	var changed bool
+
+	err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		previousStatus, err := lockStatus(ctx, tx, presence.UserId)
+		if err != nil {
+			return err
+		}
+
+		// Instances without connections of the user no longer report a status
+		if presence.Status == api.OfflineStatus {
+			_, err = tx.Exec(ctx, `DELETE FROM presence_connections WHERE user_id = $1 AND instance = $2`, presence.UserId, instance)
+		} else {
+			_, err = tx.Exec(ctx, `INSERT INTO presence_connections (user_id, instance, status, expires_at) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (user_id, instance) DO UPDATE SET status = excluded.status, expires_at = excluded.expires_at`,
+				presence.UserId, instance, presence.Status, expiresAt)
+		}
+		if err != nil {
+			return err
+		}
+
+		presence, changed, err = combineStatus(ctx, tx, presence, previousStatus)
+		return err
+	})
+	if err != nil {
+		return presence, false, err
+	}
+
+	return presence, changed, nil
+}
+
+func (s *storage) RefreshInstancePresence(instance string, expiresAt time.Time) ([]api.UserPresence, error) {
+	ctx := context.Background()
+
+	_, err := s.db.Exec(ctx, `UPDATE presence_connections SET expires_at = $2 WHERE instance = $1`, instance, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Statuses of instances that stopped without unregistering their connections
+	var userIds []string
+	err = pgxscan.Select(ctx, s.db, &userIds, `SELECT DISTINCT user_id FROM presence_connections WHERE expires_at <= now()`)
+	if err != nil {
+		return nil, err
+	}
+
+	var presences []api.UserPresence
+	for _, userId := range userIds {
+		presence := api.UserPresence{UserId: userId, LastActivity: time.Now()}
+		var changed bool
+
+		err := s.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+			previousStatus, err := lockStatus(ctx, tx, userId)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(ctx, `DELETE FROM presence_connections WHERE user_id = $1 AND expires_at <= now()`, userId)
+			if err != nil {
+				return err
+			}
+
+			presence, changed, err = combineStatus(ctx, tx, presence, previousStatus)
+			return err
+		})
+		if err != nil {
+			return presences, err
+		}
+
+		if changed {
+			presences = append(presences, presence)
+		}
+	}
+
+	return presences, nil
+}
+
+// lockStatus locks the account of a user and returns its status, so that changes
+// of the user's presence made by several instances are applied one at a time.
+func lockStatus(ctx context.Context, tx pgx.Tx, userId string) (string, error) {
+	var status string
+	err := tx.QueryRow(ctx, `SELECT status FROM user_account WHERE uid = $1 FOR UPDATE`, userId).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return api.OfflineStatus, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return status, nil
+}
+
+// combineStatus sets the status of a user to the highest status reported by the
+// instances and stores it along with the last activity of the user. It reports
+// whether the status differs from previousStatus.
+func combineStatus(ctx context.Context, tx pgx.Tx, presence api.UserPresence, previousStatus string) (api.UserPresence, bool, error) {
+	var statuses []string
+	err := pgxscan.Select(ctx, tx, &statuses, `SELECT status FROM presence_connections WHERE user_id = $1 AND expires_at > now()`, presence.UserId)
+	if err != nil {
+		return presence, false, err
+	}
+
+	presence.Status = api.OfflineStatus
+	for _, status := range statuses {
+		if statusRanks[status] > statusRanks[presence.Status] {
+			presence.Status = status
+		}
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE user_account SET status = $2, last_activity = $3 WHERE uid = $1`, presence.UserId, presence.Status, presence.LastActivity)
+	if err != nil {
+		return presence, false, err
+	}
+
+	return presence, presence.Status != previousStatus, nil
+}
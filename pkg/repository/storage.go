@@ -4,8 +4,6 @@ import (
 	"chatService/pkg/api"
 	"cloud.google.com/go/firestore"
 	"context"
-	"encoding/json"
-	jsonPatch "github.com/evanphx/json-patch/v5"
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"google.golang.org/grpc/codes"
@@ -13,18 +11,36 @@ import (
 	"log"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Storage interface {
 	GetUserByIds(userIds []string) ([]*api.UserModel, error)
 	GetUsersByUsernameContaining(query string) ([]*api.UserModel, error)
+	UpdateInstancePresence(instance string, presence api.UserPresence, expiresAt time.Time) (api.UserPresence, bool, error)
+	RefreshInstancePresence(instance string, expiresAt time.Time) ([]api.UserPresence, error)
 	UpdateConversation()
-	UpdateUserConversation(patchJson []byte, uid string, conversationId string) error
 	GetConversation(userId string, conversationId string) (api.Conversation, error)
 	GetConversations(userId string) ([]api.Conversation, error)
 	CreateConversation(newConversation api.NewConversation, userId string) (api.Conversation, error)
 	AddMessage(incomingEvent api.IncomingEvent) (api.OutgoingEvent, error)
 	AddParticipant(incomingEvent api.IncomingEvent) (api.OutgoingEvent, error)
+	RemoveMessage(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error)
+	RemoveParticipant(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error)
+	EditMessage(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error)
+	GetParticipants(conversationId string) ([]string, error)
+	MarkConversationAsRead(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error)
+	GetContactIds(userId string) ([]string, error)
+	AddReaction(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error)
+	RemoveReaction(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error)
+	GetThread(userId string, conversationId string, messageId string, before time.Time, limit int) (api.Thread, error)
+	MarkThreadAsRead(userId string, conversationId string, messageId string) error
+	GetMissedEvents(userId string, cursors map[string]int64) ([]api.OutgoingEvent, error)
+	GetEventsSince(userId string, since time.Time) ([]api.OutgoingEvent, error)
+	CreateAnnouncement(announcement api.Announcement) (api.Announcement, error)
+	GetActiveAnnouncements(now time.Time) ([]api.Announcement, error)
+	ExpireAnnouncement(announcementId string, expiresAt time.Time) (api.Announcement, error)
 }
 
 type storage struct {
@@ -39,25 +55,89 @@ func (s *storage) AddMessage(incomingEvent api.IncomingEvent) (api.OutgoingEvent
 	messageData := incomingEvent.Message
 	conversationRef := s.client.Collection("conversations").Doc(incomingEvent.ConversationId)
 
-	// Add message to conversation collection
-	messageRef, wr, err := conversationRef.Collection("messages").Add(ctx, map[string]interface{}{
-		"senderId":    messageData.SenderId,
-		"body":        messageData.Body,
-		"contentType": messageData.ContentType,
-		"createdAt":   firestore.ServerTimestamp,
+	// Replies are added to the thread of their parent message
+	if messageData.ParentMessageId != "" {
+		return s.addReply(incomingEvent)
+	}
+
+	// Add message to conversation collection with the next sequence number of the conversation
+	messageRef := newMessageRef(conversationRef.Collection("messages"), messageData)
+	var conversation api.ConversationDoc
+	var stored *api.Message
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		conversationSnap, err := tx.Get(conversationRef)
+		if err != nil {
+			return err
+		}
+
+		// Convert document to conversation struct
+		if err = conversationSnap.DataTo(&conversation); err != nil {
+			return err
+		}
+
+		// A retry of a message that was already stored returns the stored message
+		if messageData.ClientKey != "" {
+			messageSnap, err := tx.Get(messageRef)
+			if err == nil {
+				stored = &api.Message{}
+				return messageSnap.DataTo(stored)
+			} else if status.Code(err) != codes.NotFound {
+				return err
+			}
+		}
+		sequence := conversation.Sequence + 1
+
+		outgoingEvent = api.OutgoingEvent{
+			Message: &api.Message{
+				Id:          messageRef.ID,
+				Body:        messageData.Body,
+				SenderId:    messageData.SenderId,
+				ContentType: messageData.ContentType,
+				Sequence:    sequence,
+				ClientKey:   messageData.ClientKey,
+			},
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   conversation.Participants,
+		}
+
+		err = tx.Create(messageRef, map[string]interface{}{
+			"senderId":    messageData.SenderId,
+			"body":        messageData.Body,
+			"contentType": messageData.ContentType,
+			"createdAt":   firestore.ServerTimestamp,
+			"sequence":    sequence,
+			"clientKey":   messageData.ClientKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		return appendEvent(tx, conversationRef, conversation, &outgoingEvent)
 	})
 	if err != nil {
 		log.Printf("Unable to add new document: %v", err)
 		return outgoingEvent, err
 	}
 
-	// Convert document to conversation struct
-	conversationSnap, _ := conversationRef.Get(ctx)
-	var conversation api.ConversationDoc
-	if err = conversationSnap.DataTo(&conversation); err != nil {
-		log.Printf("Converting conversation snap to model struct: %v", err)
+	if stored != nil {
+		stored.Id = messageRef.ID
+		log.Printf("Skipped duplicate message with client key %s", messageData.ClientKey)
+
+		return api.OutgoingEvent{
+			Message:        stored,
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   conversation.Participants,
+			Duplicate:      true,
+		}, nil
+	}
+
+	// Used to obtain the server timestamp of the message
+	if err = stampCommittedEvent(ctx, conversationRef, &outgoingEvent); err != nil {
 		return outgoingEvent, err
 	}
+	createdAt := outgoingEvent.Message.CreatedAt
 
 	var userDocs []*firestore.DocumentRef
 	for _, id := range conversation.Participants {
@@ -85,7 +165,7 @@ func (s *storage) AddMessage(incomingEvent api.IncomingEvent) (api.OutgoingEvent
 			},
 			{
 				Path:  "lastUpdated",
-				Value: wr.UpdateTime,
+				Value: createdAt,
 			},
 		})
 		if err != nil {
@@ -94,18 +174,6 @@ func (s *storage) AddMessage(incomingEvent api.IncomingEvent) (api.OutgoingEvent
 		}
 	}
 
-	outgoingEvent = api.OutgoingEvent{
-		Message: &api.Message{
-			Id:          (*messageRef).ID,
-			Body:        messageData.Body,
-			SenderId:    messageData.SenderId,
-			ContentType: messageData.ContentType,
-			CreatedAt:   wr.UpdateTime,
-		},
-		ConversationId: incomingEvent.ConversationId,
-		RequestType:    incomingEvent.RequestType,
-		Participants:   conversation.Participants,
-	}
 	log.Printf("Created message document with reference #: %s\n", (*messageRef).ID)
 
 	return outgoingEvent, nil
@@ -118,104 +186,891 @@ func (s *storage) AddParticipant(incomingEvent api.IncomingEvent) (api.OutgoingE
 	newParticipants := incomingEvent.Participants
 	conversationRef := s.client.Collection("conversations").Doc(incomingEvent.ConversationId)
 
-	conversationSnap, err := conversationRef.Get(ctx)
-	if status.Code(err) == codes.NotFound {
-		log.Printf("Unable to find conversationRef with id %s", incomingEvent.ConversationId)
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		conversationSnap, err := tx.Get(conversationRef)
+		if status.Code(err) == codes.NotFound {
+			log.Printf("Unable to find conversationRef with id %s", incomingEvent.ConversationId)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		var conversation api.ConversationDoc
+		if err = conversationSnap.DataTo(&conversation); err != nil {
+			return err
+		}
+
+		isParticipant := make(map[string]bool, len(conversation.Participants))
+		for _, id := range conversation.Participants {
+			isParticipant[id] = true
+		}
+
+		// Combine participants and remove duplicates
+		updatedParticipants := append(append([]string{}, conversation.Participants...), newParticipants...)
+		sort.Strings(updatedParticipants)
+		j := 0
+		for i := 1; i < len(updatedParticipants); i++ {
+			if updatedParticipants[j] == updatedParticipants[i] {
+				continue
+			}
+			j++
+			updatedParticipants[j] = updatedParticipants[i]
+		}
+		updatedParticipants = updatedParticipants[:j+1]
+
+		// Participants that were not part of the conversation yet
+		var addedParticipants []string
+		for _, id := range updatedParticipants {
+			if !isParticipant[id] {
+				addedParticipants = append(addedParticipants, id)
+			}
+		}
+
+		// Add the conversation to each new participant's conversation list
+		for _, id := range addedParticipants {
+			userConversationDoc := s.client.Collection("users").Doc(id).Collection("conversations").Doc(conversationRef.ID)
+			err = tx.Set(userConversationDoc, map[string]interface{}{
+				"conversationRef": conversationRef,
+				"unreadCount":     0,
+				"lastUpdated":     firestore.ServerTimestamp,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			ConversationId:    incomingEvent.ConversationId,
+			Type:              incomingEvent.Type,
+			Participants:      conversation.Participants,
+			AddedParticipants: addedParticipants,
+		}
+
+		return appendEvent(tx, conversationRef, conversation, &outgoingEvent, firestore.Update{
+			Path:  "participants",
+			Value: updatedParticipants,
+		})
+	})
+	if err != nil {
+		log.Printf("Unable to update participants: %v", err)
 		return outgoingEvent, err
 	}
 
-	var conversation api.ConversationDoc
-	if err = conversationSnap.DataTo(&conversation); err != nil {
-		log.Println(err)
-		return outgoingEvent, err
+	log.Printf("Added new participants to conversation: %s\n", incomingEvent.ConversationId)
+
+	return outgoingEvent, nil
+}
+
+// checkRemoval allows users to leave group conversations and the creator of a group
+// conversation to remove other participants. Conversations created before their
+// creator was recorded can only be left.
+func checkRemoval(conversationType string, createdBy string, userId string, participantsToRemove []string) error {
+	if conversationType == api.OneToOneConversation {
+		return api.ErrOneToOneConversation
 	}
 
-	// Combine participants and remove duplicates
-	updatedParticipants := append(conversation.Participants, newParticipants...)
-	sort.Strings(updatedParticipants)
-	j := 0
-	for i := 1; i < len(updatedParticipants); i++ {
-		if updatedParticipants[j] == updatedParticipants[i] {
-			continue
+	for _, id := range participantsToRemove {
+		if id != userId && createdBy != userId {
+			return api.ErrNotConversationOwner
 		}
-		j++
-		updatedParticipants[j] = updatedParticipants[i]
 	}
-	updatedParticipants = updatedParticipants[:j+1]
 
-	_, err = conversationRef.Update(ctx, []firestore.Update{
-		{
+	return nil
+}
+
+// directKey identifies the one-to-one conversation between the given participants,
+// so only one such conversation is created. Group conversations have no key.
+func directKey(conversationType string, participants []string) string {
+	if conversationType != api.OneToOneConversation {
+		return ""
+	}
+
+	ids := append([]string(nil), participants...)
+	sort.Strings(ids)
+	return strings.Join(ids, ":")
+}
+
+func (s *storage) RemoveParticipant(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	conversationRef := s.client.Collection("conversations").Doc(incomingEvent.ConversationId)
+
+	// Without a participant list the user is leaving the conversation
+	participantsToRemove := incomingEvent.Participants
+	if len(participantsToRemove) == 0 {
+		participantsToRemove = []string{userId}
+	}
+
+	removeSet := make(map[string]bool, len(participantsToRemove))
+	for _, id := range participantsToRemove {
+		removeSet[id] = true
+	}
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		conversationSnap, err := tx.Get(conversationRef)
+		if status.Code(err) == codes.NotFound {
+			log.Printf("Unable to find conversationRef with id %s", incomingEvent.ConversationId)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		var conversation api.ConversationDoc
+		if err = conversationSnap.DataTo(&conversation); err != nil {
+			return err
+		}
+
+		if err = checkRemoval(conversation.Type, conversation.CreatedBy, userId, participantsToRemove); err != nil {
+			return err
+		}
+
+		// Split current participants into the ones that stay and the ones being removed
+		var remainingParticipants []string
+		var removedParticipants []string
+		for _, id := range conversation.Participants {
+			if removeSet[id] {
+				removedParticipants = append(removedParticipants, id)
+			} else {
+				remainingParticipants = append(remainingParticipants, id)
+			}
+		}
+
+		if len(removedParticipants) == 0 {
+			return api.ErrNotParticipant
+		}
+
+		// Remove the conversation from each removed user's conversation list
+		for _, id := range removedParticipants {
+			userConversationDoc := s.client.Collection("users").Doc(id).Collection("conversations").Doc(conversationRef.ID)
+			if err = tx.Delete(userConversationDoc); err != nil {
+				return err
+			}
+		}
+
+		// Notify previous participants so removed users are also told about the change
+		outgoingEvent = api.OutgoingEvent{
+			ConversationId:      incomingEvent.ConversationId,
+			Type:                incomingEvent.Type,
+			Participants:        conversation.Participants,
+			RemovedParticipants: removedParticipants,
+		}
+
+		return appendEvent(tx, conversationRef, conversation, &outgoingEvent, firestore.Update{
 			Path:  "participants",
-			Value: updatedParticipants,
-		},
+			Value: remainingParticipants,
+		})
 	})
 	if err != nil {
 		log.Printf("Unable to update participants: %v", err)
 		return outgoingEvent, err
 	}
 
-	outgoingEvent = api.OutgoingEvent{
-		ConversationId: incomingEvent.ConversationId,
-		RequestType:    incomingEvent.RequestType,
-		Participants:   conversation.Participants,
+	log.Printf("Removed participants from conversation: %s\n", incomingEvent.ConversationId)
+
+	return outgoingEvent, nil
+}
+
+func (s *storage) RemoveMessage(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	if incomingEvent.Message == nil || incomingEvent.Message.Id == "" {
+		return outgoingEvent, api.ErrMessageNotFound
 	}
 
-	log.Printf("Added new participants to conversation: %s\n", incomingEvent.ConversationId)
+	conversationRef := s.client.Collection("conversations").Doc(incomingEvent.ConversationId)
+	messageRef := s.messageRef(conversationRef, incomingEvent.Message)
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		messageSnap, err := tx.Get(messageRef)
+		if status.Code(err) == codes.NotFound {
+			log.Printf("Unable to find message with id %s", incomingEvent.Message.Id)
+			return api.ErrMessageNotFound
+		} else if err != nil {
+			return err
+		}
+
+		var message api.Message
+		if err = messageSnap.DataTo(&message); err != nil {
+			log.Printf("Converting message snap to model struct: %v", err)
+			return err
+		}
+
+		// Messages that were already removed are treated as missing
+		if message.DeletedAt != nil {
+			return api.ErrMessageNotFound
+		}
+
+		// Only the sender of a message is allowed to remove it
+		if message.SenderId != userId {
+			return api.ErrNotMessageSender
+		}
+
+		conversationSnap, err := tx.Get(conversationRef)
+		if err != nil {
+			return err
+		}
+
+		var conversation api.ConversationDoc
+		if err = conversationSnap.DataTo(&conversation); err != nil {
+			log.Printf("Converting conversation snap to model struct: %v", err)
+			return err
+		}
+
+		// Previous versions of the message are removed along with its content
+		editSnaps, err := tx.Documents(messageRef.Collection("edits")).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, editSnap := range editSnaps {
+			if err = tx.Delete(editSnap.Ref); err != nil {
+				return err
+			}
+		}
+
+		// Replace the message content with a tombstone so it keeps its place in the conversation
+		err = tx.Update(messageRef, []firestore.Update{
+			{
+				Path:  "body",
+				Value: "",
+			},
+			{
+				Path:  "attachments",
+				Value: firestore.Delete,
+			},
+			{
+				Path:  "deletedAt",
+				Value: firestore.ServerTimestamp,
+			},
+			{
+				Path:  "deletedBy",
+				Value: userId,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			Message: &api.Message{
+				Id:              messageRef.ID,
+				SenderId:        message.SenderId,
+				ContentType:     message.ContentType,
+				CreatedAt:       message.CreatedAt,
+				DeletedBy:       userId,
+				ParentMessageId: message.ParentMessageId,
+			},
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   conversation.Participants,
+		}
+
+		return appendEvent(tx, conversationRef, conversation, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to remove message: %v", err)
+		return outgoingEvent, err
+	}
+
+	// Used to obtain the server timestamp of the removal
+	if err = stampCommittedEvent(ctx, conversationRef, &outgoingEvent); err != nil {
+		return outgoingEvent, err
+	}
+	log.Printf("Removed message document with reference #: %s\n", messageRef.ID)
 
 	return outgoingEvent, nil
 }
 
-func (s *storage) UpdateConversation() {
-	//TODO implement me
-	panic("implement me")
+func (s *storage) EditMessage(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	if incomingEvent.Message == nil || incomingEvent.Message.Id == "" {
+		return outgoingEvent, api.ErrMessageNotFound
+	}
+
+	conversationRef := s.client.Collection("conversations").Doc(incomingEvent.ConversationId)
+	messageRef := s.messageRef(conversationRef, incomingEvent.Message)
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		messageSnap, err := tx.Get(messageRef)
+		if status.Code(err) == codes.NotFound {
+			log.Printf("Unable to find message with id %s", incomingEvent.Message.Id)
+			return api.ErrMessageNotFound
+		} else if err != nil {
+			return err
+		}
+
+		var message api.Message
+		if err = messageSnap.DataTo(&message); err != nil {
+			log.Printf("Converting message snap to model struct: %v", err)
+			return err
+		}
+
+		// Removed messages can no longer be edited
+		if message.DeletedAt != nil {
+			return api.ErrMessageNotFound
+		}
+
+		// Only the sender of a message is allowed to edit it
+		if message.SenderId != userId {
+			return api.ErrNotMessageSender
+		}
+
+		conversationSnap, err := tx.Get(conversationRef)
+		if err != nil {
+			return err
+		}
+
+		var conversation api.ConversationDoc
+		if err = conversationSnap.DataTo(&conversation); err != nil {
+			log.Printf("Converting conversation snap to model struct: %v", err)
+			return err
+		}
+
+		// The previous version was written either when the message was created or last edited
+		versionCreatedAt := message.CreatedAt
+		if message.EditedAt != nil {
+			versionCreatedAt = *message.EditedAt
+		}
+
+		// Save the previous version and update the message
+		err = tx.Create(messageRef.Collection("edits").NewDoc(), map[string]interface{}{
+			"body":       message.Body,
+			"createdAt":  versionCreatedAt,
+			"replacedAt": firestore.ServerTimestamp,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Update(messageRef, []firestore.Update{
+			{
+				Path:  "body",
+				Value: incomingEvent.Message.Body,
+			},
+			{
+				Path:  "editedAt",
+				Value: firestore.ServerTimestamp,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			Message: &api.Message{
+				Id:              messageRef.ID,
+				SenderId:        message.SenderId,
+				ContentType:     message.ContentType,
+				Body:            incomingEvent.Message.Body,
+				CreatedAt:       message.CreatedAt,
+				Attachments:     message.Attachments,
+				ParentMessageId: message.ParentMessageId,
+			},
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   conversation.Participants,
+		}
+
+		return appendEvent(tx, conversationRef, conversation, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to edit message: %v", err)
+		return outgoingEvent, err
+	}
+
+	// Used to obtain the server timestamp of the edit
+	if err = stampCommittedEvent(ctx, conversationRef, &outgoingEvent); err != nil {
+		return outgoingEvent, err
+	}
+	log.Printf("Edited message document with reference #: %s\n", messageRef.ID)
+
+	return outgoingEvent, nil
+}
+
+func (s *storage) GetParticipants(conversationId string) ([]string, error) {
+	ctx := context.Background()
+
+	conversationSnap, err := s.client.Collection("conversations").Doc(conversationId).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, api.ErrConversationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var conversation api.ConversationDoc
+	if err = conversationSnap.DataTo(&conversation); err != nil {
+		log.Printf("Converting conversation snap to model struct: %v", err)
+		return nil, err
+	}
+
+	return conversation.Participants, nil
 }
 
-func (s *storage) UpdateUserConversation(patchJSON []byte, uid string, conversationId string) error {
+func (s *storage) MarkConversationAsRead(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
 	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	conversationRef := s.client.Collection("conversations").Doc(incomingEvent.ConversationId)
+	userConversationRef := s.client.Collection("users").Doc(userId).Collection("conversations").Doc(conversationRef.ID)
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		userConversationSnap, err := tx.Get(userConversationRef)
+		if status.Code(err) == codes.NotFound {
+			return api.ErrNotParticipant
+		} else if err != nil {
+			return err
+		}
+
+		var userConversation api.UserConversation
+		if err = userConversationSnap.DataTo(&userConversation); err != nil {
+			log.Printf("Converting user conversation snap to model struct: %v", err)
+			return err
+		}
+
+		// Find the message the user has read up to, defaulting to the latest message
+		var messageSnap *firestore.DocumentSnapshot
+		if incomingEvent.Message != nil && incomingEvent.Message.Id != "" {
+			messageSnap, err = tx.Get(conversationRef.Collection("messages").Doc(incomingEvent.Message.Id))
+			if status.Code(err) == codes.NotFound {
+				return api.ErrMessageNotFound
+			} else if err != nil {
+				return err
+			}
+		} else {
+			query := conversationRef.Collection("messages").OrderBy("createdAt", firestore.Desc).Limit(1)
+			messageSnaps, err := tx.Documents(query).GetAll()
+			if err != nil {
+				return err
+			}
+			if len(messageSnaps) == 0 {
+				return api.ErrMessageNotFound
+			}
+			messageSnap = messageSnaps[0]
+		}
 
-	patch, err := jsonPatch.DecodePatch(patchJSON)
+		var message api.Message
+		if err = messageSnap.DataTo(&message); err != nil {
+			log.Printf("Converting message snap to model struct: %v", err)
+			return err
+		}
+
+		readReceipt := api.ReadReceipt{
+			UserId:            userId,
+			LastReadMessageId: messageSnap.Ref.ID,
+			LastReadAt:        &message.CreatedAt,
+		}
+
+		// Never move the read cursor backwards
+		if userConversation.LastReadAt != nil && !userConversation.LastReadAt.Before(message.CreatedAt) {
+			readReceipt.LastReadMessageId = userConversation.LastReadMessageId
+			readReceipt.LastReadAt = userConversation.LastReadAt
+		}
+
+		// Recompute the unread count from the messages after the read cursor
+		unreadCount, err := countUnreadMessages(tx, conversationRef, userId, *readReceipt.LastReadAt)
+		if err != nil {
+			return err
+		}
+
+		conversationSnap, err := tx.Get(conversationRef)
+		if err != nil {
+			return err
+		}
+
+		var conversation api.ConversationDoc
+		if err = conversationSnap.DataTo(&conversation); err != nil {
+			log.Printf("Converting conversation snap to model struct: %v", err)
+			return err
+		}
+
+		err = tx.Update(userConversationRef, []firestore.Update{
+			{
+				Path:  "lastReadMessageId",
+				Value: readReceipt.LastReadMessageId,
+			},
+			{
+				Path:  "lastReadAt",
+				Value: *readReceipt.LastReadAt,
+			},
+			{
+				Path:  "unreadCount",
+				Value: unreadCount,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   conversation.Participants,
+			UserId:         userId,
+			ReadReceipt:    &readReceipt,
+		}
+
+		return appendEvent(tx, conversationRef, conversation, &outgoingEvent)
+	})
 	if err != nil {
-		log.Fatalf("Decoding json patch: %v", err)
+		log.Printf("Unable to update read cursor in user collection: %v", err)
+		return outgoingEvent, err
 	}
 
-	// Get document from user conversation collection
-	userConversationDoc, err := s.client.Collection("users").Doc(uid).Collection("conversations").Doc(conversationId).Get(ctx)
+	return outgoingEvent, nil
+}
+
+// countUnreadMessages counts the messages created after lastReadAt that were not sent by the user.
+func countUnreadMessages(tx *firestore.Transaction, conversationRef *firestore.DocumentRef, userId string, lastReadAt time.Time) (int, error) {
+	query := conversationRef.Collection("messages").Where("createdAt", ">", lastReadAt)
+	messageSnaps, err := tx.Documents(query).GetAll()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// Populate struct with data from User Conversation doc
-	var userConversation api.UserConversation
-	if err := userConversationDoc.DataTo(&userConversation); err != nil {
-		return err
+	var unreadCount int
+	for _, messageSnap := range messageSnaps {
+		var message api.Message
+		if err := messageSnap.DataTo(&message); err != nil {
+			return 0, err
+		}
+		if message.SenderId != userId && message.DeletedAt == nil {
+			unreadCount++
+		}
+	}
+
+	return unreadCount, nil
+}
+
+// getReadReceipts returns the read cursor of every participant in a conversation.
+func (s *storage) getReadReceipts(ctx context.Context, conversationId string, participants []string) ([]api.ReadReceipt, error) {
+	var userConversationDocs []*firestore.DocumentRef
+	for _, id := range participants {
+		userConversationDocs = append(userConversationDocs, s.client.Collection("users").Doc(id).Collection("conversations").Doc(conversationId))
+	}
+
+	userConversationSnaps, err := s.client.GetAll(ctx, userConversationDocs)
+	if err != nil {
+		return nil, err
+	}
+
+	var readReceipts []api.ReadReceipt
+	for i, userConversationSnap := range userConversationSnaps {
+		if !userConversationSnap.Exists() {
+			continue
+		}
+
+		var userConversation api.UserConversation
+		if err := userConversationSnap.DataTo(&userConversation); err != nil {
+			return nil, err
+		}
+
+		readReceipts = append(readReceipts, api.ReadReceipt{
+			UserId:            participants[i],
+			LastReadMessageId: userConversation.LastReadMessageId,
+			LastReadAt:        userConversation.LastReadAt,
+		})
+	}
+
+	return readReceipts, nil
+}
+
+func (s *storage) GetContactIds(userId string) ([]string, error) {
+	ctx := context.Background()
+
+	// Query for every conversation the user participates in
+	conversationQuery := s.client.Collection("conversations").Where("participants", "array-contains", userId)
+	conversationSnaps, err := conversationQuery.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the other participants without duplicates
+	contactSet := make(map[string]bool)
+	var contactIds []string
+	for _, conversationSnap := range conversationSnaps {
+		var conversation api.ConversationDoc
+		if err := conversationSnap.DataTo(&conversation); err != nil {
+			return nil, err
+		}
+
+		for _, id := range conversation.Participants {
+			if id != userId && !contactSet[id] {
+				contactSet[id] = true
+				contactIds = append(contactIds, id)
+			}
+		}
+	}
+
+	return contactIds, nil
+}
+
+func (s *storage) AddReaction(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	return s.updateReaction(incomingEvent, userId, true)
+}
+
+func (s *storage) RemoveReaction(incomingEvent api.IncomingEvent, userId string) (api.OutgoingEvent, error) {
+	return s.updateReaction(incomingEvent, userId, false)
+}
+
+// updateReaction adds or removes the user from the reacting users of a message.
+func (s *storage) updateReaction(incomingEvent api.IncomingEvent, userId string, add bool) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	if incomingEvent.Message == nil || incomingEvent.Message.Id == "" {
+		return outgoingEvent, api.ErrMessageNotFound
 	}
 
-	// Convert User Conversation struct to binary array to be used by json patch function
-	userConversationBinary, err := json.Marshal(userConversation)
+	conversationRef := s.client.Collection("conversations").Doc(incomingEvent.ConversationId)
+	messageRef := s.messageRef(conversationRef, incomingEvent.Message)
+
+	// Reactions are read and written in a transaction so concurrent reactions are not lost
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		messageSnap, err := tx.Get(messageRef)
+		if status.Code(err) == codes.NotFound {
+			return api.ErrMessageNotFound
+		} else if err != nil {
+			return err
+		}
+
+		var message api.Message
+		if err = messageSnap.DataTo(&message); err != nil {
+			return err
+		}
+
+		// Removed messages can no longer receive reactions
+		if message.DeletedAt != nil {
+			return api.ErrMessageNotFound
+		}
+
+		conversationSnap, err := tx.Get(conversationRef)
+		if err != nil {
+			return err
+		}
+
+		var conversation api.ConversationDoc
+		if err = conversationSnap.DataTo(&conversation); err != nil {
+			return err
+		}
+
+		reactions := message.Reactions
+		if reactions == nil {
+			reactions = make(map[string]api.Reaction)
+		}
+
+		outgoingEvent = api.OutgoingEvent{
+			Message: &api.Message{
+				Id:              messageRef.ID,
+				Reactions:       reactions,
+				ParentMessageId: incomingEvent.Message.ParentMessageId,
+			},
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   conversation.Participants,
+			UserId:         userId,
+			Reaction:       incomingEvent.Reaction,
+		}
+
+		reaction := reactions[incomingEvent.Reaction]
+		index := -1
+		for i, id := range reaction.UserIds {
+			if id == userId {
+				index = i
+				break
+			}
+		}
+
+		// Nothing to change when the user already reacted or never reacted
+		if add == (index != -1) {
+			return nil
+		}
+
+		if add {
+			reaction.UserIds = append(reaction.UserIds, userId)
+		} else {
+			reaction.UserIds = append(reaction.UserIds[:index], reaction.UserIds[index+1:]...)
+		}
+		reaction.Count = len(reaction.UserIds)
+
+		path := firestore.FieldPath{"reactions", incomingEvent.Reaction}
+		if reaction.Count == 0 {
+			delete(reactions, incomingEvent.Reaction)
+			err = tx.Update(messageRef, []firestore.Update{
+				{
+					FieldPath: path,
+					Value:     firestore.Delete,
+				},
+			})
+		} else {
+			reactions[incomingEvent.Reaction] = reaction
+			err = tx.Update(messageRef, []firestore.Update{
+				{
+					FieldPath: path,
+					Value:     reaction,
+				},
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		return appendEvent(tx, conversationRef, conversation, &outgoingEvent)
+	})
 	if err != nil {
-		log.Fatalf("Marshalling user conversation: %v", err)
+		log.Printf("Unable to update reactions of message: %v", err)
+		return outgoingEvent, err
 	}
 
-	// Modify user conversation based on the instructions given from the json patch
-	userConversationBinary, err = patch.Apply(userConversationBinary)
+	return outgoingEvent, nil
+}
+
+func (s *storage) GetMissedEvents(userId string, cursors map[string]int64) ([]api.OutgoingEvent, error) {
+	ctx := context.Background()
+
+	// Get conversations sub-collection in user collection
+	userConversationSnaps, err := s.client.Collection("users").Doc(userId).Collection("conversations").Documents(ctx).GetAll()
 	if err != nil {
-		log.Fatalf("Applying json patch to user conversation: %v\n", err)
-		return err
+		return nil, err
+	}
+
+	isParticipant := make(map[string]bool, len(userConversationSnaps))
+	for _, userConversationSnap := range userConversationSnaps {
+		isParticipant[userConversationSnap.Ref.ID] = true
+	}
+
+	// Conversations the client has no cursor for are loaded through the REST API instead
+	conversationIds := make([]string, 0, len(cursors))
+	for conversationId := range cursors {
+		conversationIds = append(conversationIds, conversationId)
+	}
+	sort.Strings(conversationIds)
+
+	var outgoingEvents []api.OutgoingEvent
+	for _, conversationId := range conversationIds {
+		conversationRef := s.client.Collection("conversations").Doc(conversationId)
+		if conversationRef == nil {
+			continue
+		}
+
+		// Query for events the client has not seen yet, oldest first
+		var query firestore.Query
+		if isParticipant[conversationId] {
+			query = conversationRef.Collection("events").Where("sequence", ">", cursors[conversationId]).OrderBy("sequence", firestore.Asc).Limit(maxReplayEvents)
+		} else {
+			// Users removed from a conversation only learn about their removal. Its
+			// sequence is checked below, filtering on both fields needs a composite index
+			query = conversationRef.Collection("events").Where("type", "==", api.RemoveParticipant)
+		}
+		eventSnaps, err := query.Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+
+		var removal *api.OutgoingEvent
+		for _, eventSnap := range eventSnaps {
+			var event eventDoc
+			if err := eventSnap.DataTo(&event); err != nil {
+				return nil, err
+			}
+
+			outgoingEvent, err := decodeEvent(event.Type, []byte(event.Payload))
+			if err != nil {
+				return nil, err
+			}
+			stampEvent(&outgoingEvent, event.CreatedAt)
+
+			if isParticipant[conversationId] {
+				outgoingEvents = append(outgoingEvents, outgoingEvent)
+			} else if event.Sequence > cursors[conversationId] && removedUser(outgoingEvent, userId) {
+				if removal == nil || outgoingEvent.Sequence < removal.Sequence {
+					removal = &outgoingEvent
+				}
+			}
+		}
+		if removal != nil {
+			outgoingEvents = append(outgoingEvents, *removal)
+		}
 	}
 
-	err = json.Unmarshal(userConversationBinary, &userConversation)
+	return outgoingEvents, nil
+}
+
+func (s *storage) GetEventsSince(userId string, since time.Time) ([]api.OutgoingEvent, error) {
+	ctx := context.Background()
+
+	// Get conversations sub-collection in user collection
+	userConversationSnaps, err := s.client.Collection("users").Doc(userId).Collection("conversations").Documents(ctx).GetAll()
 	if err != nil {
-		log.Fatalf("Unmarshal updated user conversation in binary: %v", err)
-		return err
+		return nil, err
+	}
+
+	conversationIds := make([]string, len(userConversationSnaps))
+	isParticipant := make(map[string]bool, len(userConversationSnaps))
+	for i, userConversationSnap := range userConversationSnaps {
+		conversationIds[i] = userConversationSnap.Ref.ID
+		isParticipant[userConversationSnap.Ref.ID] = true
 	}
+	sort.Strings(conversationIds)
 
-	_, err = userConversationDoc.Ref.Set(ctx, userConversation)
+	var outgoingEvents []api.OutgoingEvent
+	for _, conversationId := range conversationIds {
+		// Events are created at the commit of their transaction, in sequence order
+		eventSnaps, err := s.client.Collection("conversations").Doc(conversationId).Collection("events").
+			Where("createdAt", ">", since).OrderBy("createdAt", firestore.Asc).Limit(maxReplayEvents).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, eventSnap := range eventSnaps {
+			outgoingEvent, err := eventFromSnap(eventSnap)
+			if err != nil {
+				return nil, err
+			}
+			outgoingEvents = append(outgoingEvents, outgoingEvent)
+		}
+	}
+
+	// Users removed from a conversation meanwhile only learn about their removal.
+	// Filtering on the creation time as well needs a composite index
+	removalSnaps, err := s.client.CollectionGroup("events").Where("removedParticipants", "array-contains", userId).Documents(ctx).GetAll()
 	if err != nil {
-		log.Printf("Setting modified data to user conversation: %v\n", err)
-		return err
+		return nil, err
 	}
 
-	return nil
+	removals := make(map[string]api.OutgoingEvent)
+	for _, removalSnap := range removalSnaps {
+		conversationId := removalSnap.Ref.Parent.Parent.ID
+		if isParticipant[conversationId] || !removalSnap.CreateTime.After(since) {
+			continue
+		}
+
+		outgoingEvent, err := eventFromSnap(removalSnap)
+		if err != nil {
+			return nil, err
+		}
+		if removal, ok := removals[conversationId]; !ok || outgoingEvent.Sequence < removal.Sequence {
+			removals[conversationId] = outgoingEvent
+		}
+	}
+
+	removedFrom := make([]string, 0, len(removals))
+	for conversationId := range removals {
+		removedFrom = append(removedFrom, conversationId)
+	}
+	sort.Strings(removedFrom)
+	for _, conversationId := range removedFrom {
+		outgoingEvents = append(outgoingEvents, removals[conversationId])
+	}
+
+	return outgoingEvents, nil
+}
+
+func (s *storage) UpdateConversation() {
+	//TODO implement me
+	panic("implement me")
 }
 
 func (s *storage) GetConversation(userId string, conversationId string) (api.Conversation, error) {
@@ -276,13 +1131,21 @@ func (s *storage) GetConversation(userId string, conversationId string) (api.Con
 		usersDTO = append(usersDTO, userDTO)
 	}
 
+	// Get how far each participant has read
+	readReceipts, err := s.getReadReceipts(ctx, conversationId, conversationDoc.Participants)
+	if err != nil {
+		log.Println(err)
+		return conversation, err
+	}
+
 	// Construct conversation output struct
 	conversation = api.Conversation{
 		Id:           conversationId,
 		Participants: usersDTO,
-		Type:         conversation.Type,
+		Type:         conversationDoc.Type,
 		Messages:     messages,
 		UnreadCount:  userConversation.UnreadCount,
+		ReadReceipts: readReceipts,
 	}
 
 	return conversation, nil
@@ -350,12 +1213,20 @@ func (s *storage) GetConversations(userId string) ([]api.Conversation, error) {
 			usersDTO = append(usersDTO, userDTO)
 		}
 
+		// Get how far each participant has read
+		readReceipts, err := s.getReadReceipts(ctx, conversationSnap.Ref.ID, conversation.Participants)
+		if err != nil {
+			return nil, err
+		}
+
 		// Create conversation output format
 		conversationDTO := api.Conversation{
 			Id:           conversationSnap.Ref.ID,
 			Participants: usersDTO,
 			Type:         conversation.Type,
 			Messages:     messages,
+			UnreadCount:  userConversation.UnreadCount,
+			ReadReceipts: readReceipts,
 		}
 
 		conversations = append(conversations, conversationDTO)
@@ -378,7 +1249,7 @@ func (s *storage) CreateConversation(newConversation api.NewConversation, userId
 	// Check if all the users exist in the database
 	if users == nil || len(users) != len(newConversation.Participants) {
 		log.Println("One of the users was not found")
-		return conversation, err
+		return conversation, api.ErrUserNotFound
 	}
 
 	var usersDTO []api.User
@@ -387,52 +1258,81 @@ func (s *storage) CreateConversation(newConversation api.NewConversation, userId
 		usersDTO = append(usersDTO, userDTO)
 	}
 
-	// Query for conversations that contain exact participants
+	conversationType := api.OneToOneConversation
+	if len(newConversation.Participants) > 2 {
+		conversationType = api.GroupConversation
+	}
+
+	// Only one one-to-one conversation exists per pair of users
+	key := directKey(conversationType, newConversation.Participants)
 	conversations := s.client.Collection("conversations")
-	conversationQuery := conversations.Where("participants", "in", newConversation.Participants)
-	conversationSnaps, _ := conversationQuery.Documents(ctx).GetAll()
+	conversationRef := conversations.NewDoc()
+	err = s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if key != "" {
+			existingSnaps, err := tx.Documents(conversations.Where("directKey", "==", key).Limit(1)).GetAll()
+			if err != nil {
+				return err
+			}
+			if len(existingSnaps) != 0 {
+				return api.ErrConversationExists
+			}
+		}
 
-	// TODO perhaps I should remove this to allow multiple groups with same participants w/ maybe a group name
-	// Check if a conversation already exists with the requested participants
-	if len(conversationSnaps) != 0 {
-		// http.Error(w, "Conversation with these participants already exist", http.StatusConflict)
+		// Create new conversation document in conversations collection
+		return tx.Create(conversationRef, map[string]interface{}{
+			"participants": newConversation.Participants,
+			"type":         conversationType,
+			"sequence":     1,
+			"createdBy":    userId,
+			"directKey":    key,
+		})
+	})
+	if err != nil {
+		log.Printf("Unable to add conversation to firestore: %v", err)
 		return conversation, err
 	}
+	log.Printf("Created conversation with id: %s\n", (*conversationRef).ID)
 
-	conversationType := "ONE_TO_ONE"
-	if len(newConversation.Participants) > 2 {
-		conversationType = "GROUP"
-	}
-
-	// Create new conversation document in conversations collection
-	conversationRef, _, err := s.client.Collection("conversations").Add(ctx, map[string]interface{}{
-		"participants": newConversation.Participants,
-		"type":         conversationType,
+	// Create the first message together with the first event of the conversation
+	messageRef := conversationRef.Collection("messages").NewDoc()
+	eventData, err := newEventData(api.OutgoingEvent{
+		Message: &api.Message{
+			Id:          messageRef.ID,
+			SenderId:    newConversation.Message.SenderId,
+			ContentType: newConversation.Message.ContentType,
+			Body:        newConversation.Message.Body,
+			Sequence:    1,
+		},
+		ConversationId: conversationRef.ID,
+		Type:           api.AddMessage,
+		Participants:   newConversation.Participants,
+		Sequence:       1,
 	})
 	if err != nil {
-		// http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Fatalf("Unable to add conversation to firestore: %v", err)
+		return conversation, err
 	}
-	log.Printf("Created conversation with id: %s\n", (*conversationRef).ID)
 
-	// Create new message document
-	messageRef, _, err := conversationRef.Collection("messages").Add(ctx, map[string]interface{}{
+	batch := s.client.Batch()
+	batch.Create(messageRef, map[string]interface{}{
 		"senderId":    newConversation.Message.SenderId,
 		"body":        newConversation.Message.Body,
 		"contentType": newConversation.Message.ContentType,
 		"createdAt":   firestore.ServerTimestamp,
+		"sequence":    1,
 	})
-	if err != nil {
+	batch.Create(eventRef(conversationRef, 1), eventData)
+	if _, err = batch.Commit(ctx); err != nil {
 		log.Printf("Unable to add message document: %v", err)
 		//http.Error(w, err.Error(), http.StatusInternalServerError)
-		return conversation, nil
+		return conversation, err
 	}
 	log.Printf("Created message document with reference #: %s\n", (*messageRef).ID)
 
 	// Used to obtain the update timestamp
 	conversationDoc, err := conversationRef.Get(ctx)
 	if err != nil {
-		log.Fatalf("Could not retrieve conversation document: %s", err)
+		log.Printf("Could not retrieve conversation document: %s", err)
+		return conversation, err
 	}
 
 	var userDocs []*firestore.DocumentRef
@@ -443,7 +1343,8 @@ func (s *storage) CreateConversation(newConversation api.NewConversation, userId
 	// Get snapshot of each participant
 	userSnaps, err := s.client.GetAll(ctx, userDocs)
 	if err != nil {
-		log.Fatalln(err)
+		log.Printf("Unable to get participants %v: %v", newConversation.Participants, err)
+		return conversation, err
 	}
 
 	// Create a user conversation doc for each participant
@@ -460,26 +1361,51 @@ func (s *storage) CreateConversation(newConversation api.NewConversation, userId
 			"conversationRef": conversationRef,
 			"unreadCount":     unreadCount,
 			"updateTimestamp": conversationDoc.UpdateTime,
+			"lastUpdated":     conversationDoc.UpdateTime,
 		})
 		if err != nil {
-			// http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Fatalf("Unable to add conversation to user in firestore: %s", err)
+			log.Printf("Unable to add conversation to user in firestore: %s", err)
+			return conversation, err
 		}
 	}
+	// Used to obtain the server timestamp of the first message
+	messageSnap, err := messageRef.Get(ctx)
+	if err != nil {
+		return conversation, err
+	}
+
 	// Construct conversation output
 	conversation = api.Conversation{
 		Id:           conversationRef.ID,
 		Participants: usersDTO,
 		Type:         conversationType,
-		Messages:     []api.Message{},
-		UnreadCount:  0,
+		Messages: []api.Message{
+			{
+				Id:          messageRef.ID,
+				SenderId:    newConversation.Message.SenderId,
+				ContentType: newConversation.Message.ContentType,
+				Body:        newConversation.Message.Body,
+				CreatedAt:   messageSnap.CreateTime,
+				Sequence:    1,
+			},
+		},
+		UnreadCount: 0,
 	}
 
 	return conversation, nil
 }
 
 func (s *storage) GetUserByIds(uIds []string) ([]*api.UserModel, error) {
+	return getUserByIds(context.Background(), s.db, uIds)
+}
+
+// getUserByIds returns the users found in the user_account table.
+func getUserByIds(ctx context.Context, db pgxscan.Querier, uIds []string) ([]*api.UserModel, error) {
 	var users []*api.UserModel
+	if len(uIds) == 0 {
+		return users, nil
+	}
+
 	ids := make([]interface{}, len(uIds))
 	ids[0] = uIds[0]
 	inStmt := "$1"
@@ -487,7 +1413,7 @@ func (s *storage) GetUserByIds(uIds []string) ([]*api.UserModel, error) {
 		inStmt = inStmt + ",$" + strconv.Itoa(i+1)
 		ids[i] = uIds[i]
 	}
-	if err := pgxscan.Select(context.Background(), s.db, &users, "SELECT * FROM user_account WHERE uid IN ("+inStmt+")", ids...); err != nil {
+	if err := pgxscan.Select(ctx, db, &users, "SELECT * FROM user_account WHERE uid IN ("+inStmt+")", ids...); err != nil {
 		return nil, err
 	}
 	return users, nil
@@ -0,0 +1,283 @@
+package repository
+
+import (
+	"chatService/pkg/api"
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"time"
+)
+
+// messageRef returns the document of a message. Replies are stored in the replies
+// sub-collection of their parent message instead of the conversation's messages.
+func (s *storage) messageRef(conversationRef *firestore.DocumentRef, message *api.Message) *firestore.DocumentRef {
+	messages := conversationRef.Collection("messages")
+	if message.ParentMessageId != "" {
+		return messages.Doc(message.ParentMessageId).Collection("replies").Doc(message.Id)
+	}
+	return messages.Doc(message.Id)
+}
+
+// newMessageRef returns the document for a new message. Messages with a client key
+// get an id derived from the sender and the key, so retries map to the same document.
+func newMessageRef(messages *firestore.CollectionRef, message *api.Message) *firestore.DocumentRef {
+	if message.ClientKey == "" {
+		return messages.NewDoc()
+	}
+
+	hash := sha256.Sum256([]byte(message.SenderId + "/" + message.ClientKey))
+	return messages.Doc(hex.EncodeToString(hash[:]))
+}
+
+// userThreadRef returns the document holding a user's unread state of a thread.
+func (s *storage) userThreadRef(userId string, conversationId string, messageId string) *firestore.DocumentRef {
+	return s.client.Collection("users").Doc(userId).Collection("conversations").Doc(conversationId).Collection("threads").Doc(messageId)
+}
+
+func (s *storage) addReply(incomingEvent api.IncomingEvent) (api.OutgoingEvent, error) {
+	ctx := context.Background()
+	var outgoingEvent api.OutgoingEvent
+
+	messageData := incomingEvent.Message
+	conversationRef := s.client.Collection("conversations").Doc(incomingEvent.ConversationId)
+	rootRef := conversationRef.Collection("messages").Doc(messageData.ParentMessageId)
+
+	// Add the reply with the next sequence number of the conversation and update the
+	// thread summary on the root message in a single transaction
+	replyRef := newMessageRef(rootRef.Collection("replies"), messageData)
+	var root api.Message
+	var conversation api.ConversationDoc
+	var stored *api.Message
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		rootSnap, err := tx.Get(rootRef)
+		if status.Code(err) == codes.NotFound {
+			log.Printf("Unable to find parent message with id %s", messageData.ParentMessageId)
+			return api.ErrMessageNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if err = rootSnap.DataTo(&root); err != nil {
+			log.Printf("Converting message snap to model struct: %v", err)
+			return err
+		}
+
+		// Removed messages can no longer be replied to
+		if root.DeletedAt != nil {
+			return api.ErrMessageNotFound
+		}
+
+		conversationSnap, err := tx.Get(conversationRef)
+		if err != nil {
+			return err
+		}
+
+		if err = conversationSnap.DataTo(&conversation); err != nil {
+			return err
+		}
+
+		// A retry of a reply that was already stored returns the stored reply
+		if messageData.ClientKey != "" {
+			replySnap, err := tx.Get(replyRef)
+			if err == nil {
+				stored = &api.Message{}
+				return replySnap.DataTo(stored)
+			} else if status.Code(err) != codes.NotFound {
+				return err
+			}
+		}
+		sequence := conversation.Sequence + 1
+
+		outgoingEvent = api.OutgoingEvent{
+			Message: &api.Message{
+				Id:              replyRef.ID,
+				Body:            messageData.Body,
+				SenderId:        messageData.SenderId,
+				ContentType:     messageData.ContentType,
+				ParentMessageId: rootRef.ID,
+				Sequence:        sequence,
+				ClientKey:       messageData.ClientKey,
+			},
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   conversation.Participants,
+		}
+
+		err = tx.Create(replyRef, map[string]interface{}{
+			"senderId":        messageData.SenderId,
+			"body":            messageData.Body,
+			"contentType":     messageData.ContentType,
+			"createdAt":       firestore.ServerTimestamp,
+			"parentMessageId": rootRef.ID,
+			"sequence":        sequence,
+			"clientKey":       messageData.ClientKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Update(rootRef, []firestore.Update{
+			{
+				Path:  "replyCount",
+				Value: firestore.Increment(1),
+			},
+			{
+				Path:  "lastReplyAt",
+				Value: firestore.ServerTimestamp,
+			},
+			{
+				Path:  "threadParticipants",
+				Value: firestore.ArrayUnion(messageData.SenderId),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		return appendEvent(tx, conversationRef, conversation, &outgoingEvent)
+	})
+	if err != nil {
+		log.Printf("Unable to add reply: %v", err)
+		return outgoingEvent, err
+	}
+
+	if stored != nil {
+		stored.Id = replyRef.ID
+		log.Printf("Skipped duplicate reply with client key %s", messageData.ClientKey)
+
+		return api.OutgoingEvent{
+			Message:        stored,
+			ConversationId: incomingEvent.ConversationId,
+			Type:           incomingEvent.Type,
+			Participants:   conversation.Participants,
+			Duplicate:      true,
+		}, nil
+	}
+
+	// Used to obtain the server timestamp of the reply
+	if err = stampCommittedEvent(ctx, conversationRef, &outgoingEvent); err != nil {
+		return outgoingEvent, err
+	}
+	createdAt := outgoingEvent.Message.CreatedAt
+
+	isParticipant := make(map[string]bool, len(conversation.Participants))
+	for _, id := range conversation.Participants {
+		isParticipant[id] = true
+	}
+
+	// Users following the thread are the author of the root message and everyone who replied
+	followers := append([]string{root.SenderId}, root.ThreadParticipants...)
+	notified := make(map[string]bool)
+	for _, id := range followers {
+		if id == messageData.SenderId || notified[id] || !isParticipant[id] {
+			continue
+		}
+		notified[id] = true
+
+		_, err = s.userThreadRef(id, conversationRef.ID, rootRef.ID).Set(ctx, map[string]interface{}{
+			"unreadCount": firestore.Increment(1),
+			"lastUpdated": createdAt,
+		}, firestore.MergeAll)
+		if err != nil {
+			log.Printf("Unable to update thread in user collection: %v", err)
+			return outgoingEvent, err
+		}
+	}
+	log.Printf("Created reply document with reference #: %s\n", replyRef.ID)
+
+	return outgoingEvent, nil
+}
+
+func (s *storage) GetThread(userId string, conversationId string, messageId string, before time.Time, limit int) (api.Thread, error) {
+	ctx := context.Background()
+	var thread api.Thread
+
+	// Only participants of the conversation can read its threads
+	_, err := s.client.Collection("users").Doc(userId).Collection("conversations").Doc(conversationId).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return thread, api.ErrNotParticipant
+	} else if err != nil {
+		return thread, err
+	}
+
+	rootRef := s.client.Collection("conversations").Doc(conversationId).Collection("messages").Doc(messageId)
+	rootSnap, err := rootRef.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return thread, api.ErrMessageNotFound
+	} else if err != nil {
+		return thread, err
+	}
+
+	var root api.Message
+	if err = rootSnap.DataTo(&root); err != nil {
+		log.Printf("Converting message snap to model struct: %v", err)
+		return thread, err
+	}
+	root.Id = rootRef.ID
+
+	// Page backwards through the replies starting from the newest
+	query := rootRef.Collection("replies").OrderBy("createdAt", firestore.Desc).Limit(limit)
+	if !before.IsZero() {
+		query = query.Where("createdAt", "<", before)
+	}
+	replyDocs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return thread, err
+	}
+
+	replies := []api.Message{}
+	for _, replyDoc := range replyDocs {
+		var reply api.Message
+		if err := replyDoc.DataTo(&reply); err != nil {
+			return thread, err
+		}
+		reply.Id = replyDoc.Ref.ID
+		replies = append([]api.Message{reply}, replies...)
+	}
+
+	// Get the user's unread state of the thread, which does not exist until someone replies
+	var userThread api.UserThread
+	userThreadSnap, err := s.userThreadRef(userId, conversationId, messageId).Get(ctx)
+	if err == nil {
+		if err := userThreadSnap.DataTo(&userThread); err != nil {
+			return thread, err
+		}
+	} else if status.Code(err) != codes.NotFound {
+		return thread, err
+	}
+
+	thread = api.Thread{
+		Root:        root,
+		Replies:     replies,
+		UnreadCount: userThread.UnreadCount,
+	}
+
+	return thread, nil
+}
+
+func (s *storage) MarkThreadAsRead(userId string, conversationId string, messageId string) error {
+	ctx := context.Background()
+
+	// Only participants of the conversation can read its threads
+	_, err := s.client.Collection("users").Doc(userId).Collection("conversations").Doc(conversationId).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return api.ErrNotParticipant
+	} else if err != nil {
+		return err
+	}
+
+	_, err = s.userThreadRef(userId, conversationId, messageId).Set(ctx, map[string]interface{}{
+		"unreadCount": 0,
+		"lastReadAt":  firestore.ServerTimestamp,
+	}, firestore.MergeAll)
+	if err != nil {
+		log.Printf("Unable to mark thread as read: %v", err)
+		return err
+	}
+
+	return nil
+}